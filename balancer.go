@@ -3,6 +3,18 @@
 //
 // The hashing algorithm is customizable, but xxhash is recommended.
 //
+// The balancer is registered with gRPC through a Builder, which can be
+// customized with BuilderOptions:
+// ```go
+// builder := consistent.NewBuilder(xxhash.Sum64,
+// consistent.WithKeyFunc(consistent.MetadataKeyFunc("x-shard-key")),
+// consistent.WithDefaultSpread(2),
+// consistent.WithHealthCheck(),
+// consistent.WithLogger(grpclog.Component("my-balancer")),
+// )
+// balancer.Register(builder)
+// ```
+//
 // A large portion of the structure of this library is based off of the example
 // implementation in grpc-go. That original work is copyrighted by the gRPC
 // authors and licensed under the Apache License, Version 2.0.
@@ -12,18 +24,30 @@
 package consistent
 
 import (
+	"container/list"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/maphash"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 
 	"github.com/authzed/consistent/hashring"
 )
@@ -39,9 +63,31 @@ const (
 	// that points to the value that will be hashed in order to map the request
 	// to the hashring.
 	//
-	// The value stored at this key must be []byte.
+	// The value stored at this key must be []byte or string; WithRequestKey,
+	// ContextWithKey, and RequestKeyFromContext take care of that.
 	CtxKey ctxKey = "requestKey"
 
+	// SpreadKey is the key that may be present in a gRPC request's context to
+	// override the configured spread for that request.
+	//
+	// The value stored at this key must be uint8.
+	SpreadKey ctxKey = "spread"
+
+	// ReplicaKey is the key that may be present in a gRPC request's context to
+	// pin the request to one of the members selected by spread, by its index
+	// in hashring order, rather than letting the picker choose.
+	//
+	// The value stored at this key must be uint8; ContextWithReplica takes
+	// care of that.
+	ReplicaKey ctxKey = "replica"
+
+	// ReplicasKey is the key that may be present in a gRPC request's context
+	// to record the members selected by spread for the request.
+	//
+	// The value stored at this key must be a *Replicas; ContextWithReplicas
+	// takes care of that.
+	ReplicasKey ctxKey = "replicas"
+
 	// DefaultReplicationFactor is the value that will be used when parsing a
 	// service config provides an invalid value.
 	DefaultReplicationFactor = 100
@@ -49,8 +95,221 @@ const (
 	// DefaultSpread is the value that will be used when parsing a service
 	// config provides an invalid value.
 	DefaultSpread = 1
+
+	// DefaultReplicationFactorWarningThreshold is the replication factor above
+	// which parsing a service config logs a warning, since building a hashring
+	// with that many virtual nodes per member takes a lot of memory.
+	DefaultReplicationFactorWarningThreshold = 5000
 )
 
+// ContextWithKey returns a copy of ctx carrying the provided key under CtxKey,
+// which will be hashed to pick a backend for any request made with it.
+func ContextWithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, CtxKey, key)
+}
+
+// WithRequestKey returns a copy of ctx carrying the provided key under CtxKey,
+// like ContextWithKey, for keys that are already a []byte.
+func WithRequestKey(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, CtxKey, key)
+}
+
+// RequestKeyFromContext returns the request key stored in ctx at CtxKey, such
+// as by WithRequestKey or ContextWithKey, and whether there is one. A value
+// that isn't a []byte or string isn't a request key.
+func RequestKeyFromContext(ctx context.Context) ([]byte, bool) {
+	switch v := ctx.Value(CtxKey).(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	default:
+		return nil, false
+	}
+}
+
+// ContextWithSpread returns a copy of ctx that overrides the configured spread
+// for any request made with it.
+//
+// The spread is clamped between 1 and the number of members in the hashring.
+func ContextWithSpread(ctx context.Context, spread uint8) context.Context {
+	return context.WithValue(ctx, SpreadKey, spread)
+}
+
+// ContextWithReplica returns a copy of ctx that pins any request made with it
+// to the member at index replica, modulo the spread, among the members
+// selected by spread in hashring order, such as to retry a failed request on
+// the next replica. The member is used even if it isn't Ready or is
+// overloaded, so FallbackToNext, MaxLoadFactor, and the SpreadStrategy don't
+// apply.
+func ContextWithReplica(ctx context.Context, replica uint8) context.Context {
+	return context.WithValue(ctx, ReplicaKey, replica)
+}
+
+// Replicas records the keys of the members selected by spread for a request,
+// in hashring order, which are the candidates the picker chose among.
+//
+// gRPC's retries, as configured by a retryPolicy in the service config, pick
+// again with the request's context, so unless Spread is greater than 1 they
+// retry on the same member. To retry on the next replica instead, an
+// interceptor can record the replicas of a request and pin further attempts
+// to each of the others in turn with ContextWithReplica. Such an interceptor
+// is best paired with a service config without a retryPolicy, or with one that
+// only retries codes that the same member may recover from. The following
+// example sends each request to the owner of its key, then to the next two
+// members along the hashring if that fails:
+// ```go
+// func retryReplicas(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+// ctx = consistent.ContextWithSpread(ctx, 3)
+// var replicas consistent.Replicas
+// err := invoker(consistent.ContextWithReplicas(consistent.ContextWithReplica(ctx, 0), &replicas), method, req, reply, cc, opts...)
+// for i := 1; i < len(replicas.Keys()) && status.Code(err) == codes.Unavailable; i++ {
+// err = invoker(consistent.ContextWithReplica(ctx, uint8(i)), method, req, reply, cc, opts...)
+// }
+// return err
+// }
+// ```
+type Replicas struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+// ContextWithReplicas returns a copy of ctx that records the replicas of any
+// request made with it in replicas. Each pick replaces the keys recorded by
+// any earlier one.
+func ContextWithReplicas(ctx context.Context, replicas *Replicas) context.Context {
+	return context.WithValue(ctx, ReplicasKey, replicas)
+}
+
+// Keys returns the keys of the members that were recorded, the first of which
+// owns the request's key, or nil if no request has been picked.
+func (r *Replicas) Keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.keys
+}
+
+// record replaces the recorded keys with those of members.
+func (r *Replicas) record(members []hashring.Member) {
+	keys := make([]string, 0, len(members))
+	for _, m := range members {
+		keys = append(keys, m.Key())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+}
+
+type attributeKey string
+
+// WeightAttributeKey is the key of a resolver.Address's BalancerAttributes
+// that holds the weight of the backend at that address. A backend is given
+// weight times the replication factor virtual nodes on the hashring, and so
+// receives a proportionally larger share of keys.
+//
+// For a resolver.Endpoint, the weight is read from its Attributes, falling
+// back to the BalancerAttributes of its first address.
+//
+// The value stored at this key must be a uint16 greater than 0; addresses
+// without it have a weight of 1.
+var WeightAttributeKey = attributeKey("weight")
+
+// AddressWithWeight returns a copy of addr carrying the provided weight under
+// WeightAttributeKey.
+func AddressWithWeight(addr resolver.Address, weight uint16) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(WeightAttributeKey, weight)
+	return addr
+}
+
+// addressWeight returns the weight of addr, defaulting to 1.
+func addressWeight(addr resolver.Address) uint16 {
+	if weight, ok := addr.BalancerAttributes.Value(WeightAttributeKey).(uint16); ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// endpointWeight returns the weight of ep, defaulting to the weight of its
+// first address.
+func endpointWeight(ep resolver.Endpoint) uint16 {
+	if weight, ok := ep.Attributes.Value(WeightAttributeKey).(uint16); ok && weight > 0 {
+		return weight
+	}
+	return addressWeight(ep.Addresses[0])
+}
+
+// endpointKey returns the hashring key of ep: the keys of its addresses,
+// sorted so that it doesn't depend on the order the resolver lists them in,
+// and joined by commas. An endpoint with a single address has the same key as
+// that address.
+func endpointKey(ep resolver.Endpoint, keyFn MemberKeyFunc) string {
+	keys := make([]string, 0, len(ep.Addresses))
+	for _, addr := range ep.Addresses {
+		keys = append(keys, keyFn(addr))
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ",")
+}
+
+// uniqueAddresses returns addrs without the addresses whose hashring key is
+// the same as an earlier address's, along with the keys of those it dropped.
+// addrs is returned as is when there are none.
+func uniqueAddresses(addrs []resolver.Address, keyFn MemberKeyFunc) ([]resolver.Address, []string) {
+	seen := make(map[string]struct{}, len(addrs))
+	var unique []resolver.Address
+	var duplicates []string
+	for i, addr := range addrs {
+		key := keyFn(addr)
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			if unique != nil {
+				unique = append(unique, addr)
+			}
+			continue
+		}
+
+		if unique == nil {
+			unique = append(make([]resolver.Address, 0, len(addrs)-1), addrs[:i]...)
+		}
+		duplicates = append(duplicates, key)
+	}
+	if unique == nil {
+		return addrs, nil
+	}
+
+	return unique, duplicates
+}
+
+// sameTargets reports whether a and b connect to the same addresses. Like
+// endpointKey, it ignores the order of the addresses; it also ignores their
+// attributes, so that changes such as to a weight don't cause reconnects.
+func sameTargets(a, b []resolver.Address) bool {
+	return len(a) == len(b) && endpointKey(resolver.Endpoint{Addresses: a}, DefaultMemberKey) ==
+		endpointKey(resolver.Endpoint{Addresses: b}, DefaultMemberKey)
+}
+
+// resolvedEndpoints returns the endpoints of state, or if it has none, an
+// endpoint for each of its addresses, carrying that address's
+// BalancerAttributes the same way gRPC converts them.
+func resolvedEndpoints(state resolver.State) []resolver.Endpoint {
+	if len(state.Endpoints) > 0 {
+		return state.Endpoints
+	}
+
+	endpoints := make([]resolver.Endpoint, 0, len(state.Addresses))
+	for _, addr := range state.Addresses {
+		endpoints = append(endpoints, resolver.Endpoint{
+			Addresses:  []resolver.Address{addr},
+			Attributes: addr.BalancerAttributes,
+		})
+	}
+
+	return endpoints
+}
+
 // DefaultServiceConfigJSON is a helper to easily leverage the defaults.
 //
 // Here's an example:
@@ -73,8 +332,159 @@ type BalancerConfig struct {
 	serviceconfig.LoadBalancingConfig `json:"-"`
 	ReplicationFactor                 uint16 `json:"replicationFactor,omitempty"`
 	Spread                            uint8  `json:"spread,omitempty"`
+
+	// FallbackToNext makes the picker walk further along the hashring when the
+	// chosen subconnection is not Ready, using the first Ready subconnection it
+	// finds instead.
+	FallbackToNext bool `json:"fallbackToNext,omitempty"`
+
+	// EnableHealthCheck enables client-side health checking of subconnections
+	// and makes the picker prefer Ready subconnections among the candidates
+	// selected by Spread.
+	//
+	// gRPC only performs health checks when the service config also contains a
+	// `healthCheckConfig` with a `serviceName`, and the
+	// `google.golang.org/grpc/health` package has been imported to register
+	// the health check client. Unhealthy subconnections are reported in
+	// TransientFailure.
+	//
+	// Health checking is off by default. Turning it on or off in a later
+	// config reconnects every subconnection, since it can only be set when a
+	// subconnection is created.
+	EnableHealthCheck bool `json:"enableHealthCheck,omitempty"`
+
+	// HealthCheckEnabled enables client-side health checking of
+	// subconnections like EnableHealthCheck, but without changing how the
+	// picker chooses among the candidates selected by Spread, such as to
+	// report unhealthy backends in TransientFailure for FallbackToNext or
+	// PickWait to act on. The same requirements apply, and changing whether
+	// health checking is on likewise reconnects every subconnection.
+	HealthCheckEnabled bool `json:"healthCheckEnabled,omitempty"`
+
+	// HashFunc is the name of a hash function registered with
+	// RegisterHashFunc that the hashring will use instead of the one provided
+	// to NewBuilder.
+	HashFunc string `json:"hashFunc,omitempty"`
+
+	// MaxLoadFactor enables consistent hashing with bounded loads when set. A
+	// subconnection is skipped in favor of the next one along the hashring
+	// while its in-flight requests exceed MaxLoadFactor times the average
+	// across all subconnections, which keeps a hot key from overloading a
+	// single backend. In-flight requests are tracked through the Done callback
+	// of each pick. It must be 0 or at least 1; 1.25 is a common choice.
+	MaxLoadFactor float64 `json:"maxLoadFactor,omitempty"`
+
+	// SpreadStrategy selects how the picker chooses among the candidates
+	// selected by Spread. SpreadRandom is used when it's empty.
+	SpreadStrategy SpreadStrategy `json:"spreadStrategy,omitempty"`
+
+	// SpreadWeights biases the random choice among the candidates selected by
+	// Spread toward the earlier ones along the hashring, such as [0.7, 0.2,
+	// 0.1] to send most requests to a key's owner for cache locality while
+	// still spreading some to the next two members. There must be one weight
+	// per candidate, and the weights must sum to 1.
+	//
+	// When fewer candidates are considered, such as because there are fewer
+	// members than Spread, ContextWithSpread lowers it, or EnableHealthCheck
+	// excludes some, the weights of the remaining ones are used in
+	// proportion; a spread raised with ContextWithSpread chooses uniformly.
+	// Weights can only be used with SpreadRandom. Candidates are chosen
+	// uniformly when unset.
+	SpreadWeights []float64 `json:"spreadWeights,omitempty"`
+
+	// EmptyUpdateGrace keeps the balancer serving from the last known
+	// hashring for this long after the resolver returns zero addresses,
+	// rather than failing every pick right away, so that a brief blip in
+	// resolution doesn't turn into an outage. The balancer only fails once
+	// the grace period passes without the resolver returning addresses
+	// again. In JSON, it's a duration string such as "10s".
+	EmptyUpdateGrace time.Duration `json:"-"`
+
+	// PickCacheSize enables a cache of the candidates along the hashring for
+	// up to this many of the most recently picked keys, which saves walking
+	// the hashring when bursts of requests share the same key. Each pick
+	// still chooses among the cached candidates as it would otherwise, such
+	// as at random when Spread is greater than 1. The cache is emptied every
+	// time the picker is rebuilt, such as when the hashring changes or a
+	// subconnection's state does. Looking up a single candidate is about as
+	// cheap as the cache, so it mostly pays off when Spread is greater than
+	// 1. It's off when 0.
+	PickCacheSize int `json:"pickCacheSize,omitempty"`
+
+	// PickWait makes the picker return balancer.ErrNoSubConnAvailable when
+	// the subconnection it chooses isn't Ready, such as while a key's owner
+	// is reconnecting, so that gRPC blocks the RPC until a new picker is
+	// built or the RPC's deadline passes, rather than sending it to a
+	// subconnection that can't serve it.
+	//
+	// Without FallbackToNext, every request for a key goes to the members
+	// that own it, and PickWait keeps that guarantee at the cost of latency:
+	// requests wait out their owner's reconnection, and requests without a
+	// deadline can wait indefinitely. With FallbackToNext, requests only wait
+	// when none of the members along the hashring are Ready.
+	PickWait bool `json:"pickWait,omitempty"`
+}
+
+// balancerConfigJSON has the fields of BalancerConfig without its JSON
+// methods.
+type balancerConfigJSON BalancerConfig
+
+// MarshalJSON encodes the config, with EmptyUpdateGrace as a duration string
+// in seconds, as is conventional for service configs.
+func (c BalancerConfig) MarshalJSON() ([]byte, error) {
+	var grace string
+	if c.EmptyUpdateGrace != 0 {
+		grace = strconv.FormatFloat(c.EmptyUpdateGrace.Seconds(), 'f', -1, 64) + "s"
+	}
+
+	return json.Marshal(struct {
+		balancerConfigJSON
+		EmptyUpdateGrace string `json:"emptyUpdateGrace,omitempty"`
+	}{balancerConfigJSON(c), grace})
+}
+
+// UnmarshalJSON decodes the config, accepting any duration string that
+// time.ParseDuration does for EmptyUpdateGrace.
+func (c *BalancerConfig) UnmarshalJSON(data []byte) error {
+	decoded := struct {
+		*balancerConfigJSON
+		EmptyUpdateGrace string `json:"emptyUpdateGrace,omitempty"`
+	}{balancerConfigJSON: (*balancerConfigJSON)(c)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	c.EmptyUpdateGrace = 0
+	if decoded.EmptyUpdateGrace != "" {
+		grace, err := time.ParseDuration(decoded.EmptyUpdateGrace)
+		if err != nil {
+			return fmt.Errorf("invalid emptyUpdateGrace: %w", err)
+		}
+		c.EmptyUpdateGrace = grace
+	}
+
+	return nil
 }
 
+// SpreadStrategy is a way of choosing among the candidates for a request when
+// Spread is greater than 1.
+type SpreadStrategy string
+
+const (
+	// SpreadRandom chooses a candidate uniformly at random.
+	SpreadRandom SpreadStrategy = "random"
+
+	// SpreadLeastLoaded chooses the candidate with the fewest in-flight
+	// requests, breaking ties at random.
+	SpreadLeastLoaded SpreadStrategy = "leastLoaded"
+
+	// SpreadPowerOfTwo chooses two candidates at random and uses the one with
+	// fewer in-flight requests, which smooths load nearly as well as
+	// SpreadLeastLoaded without every request piling onto whichever
+	// candidate is momentarily least loaded.
+	SpreadPowerOfTwo SpreadStrategy = "powerOfTwo"
+)
+
 // ServiceConfigJSON encodes the current config into the gRPC Service Config
 // JSON format.
 func (c *BalancerConfig) ServiceConfigJSON() (string, error) {
@@ -105,6 +515,38 @@ func (c *BalancerConfig) MustServiceConfigJSON() string {
 
 var logger = grpclog.Component("consistenthashring")
 
+// ErrEmptyKey is returned by a picker built with WithRejectEmptyKeys when a
+// request's key is empty.
+var ErrEmptyKey = errors.New("request key is empty")
+
+// ErrZeroAddresses is the resolver error recorded when the resolver produces
+// no addresses. Once the balancer has no subconnections left, pickers fail
+// requests with an error that wraps it, joined with the last connection error
+// of each backend.
+var ErrZeroAddresses = errors.New("produced zero addresses")
+
+// ErrHashringMutation is matched by every HashringMutationError.
+var ErrHashringMutation = errors.New("couldn't change hashring")
+
+// HashringMutationError is returned by UpdateClientConnState when the
+// hashring couldn't be changed to match a resolver update or service config.
+// It matches ErrHashringMutation with errors.Is and wraps the hashring's
+// error, such as hashring.ErrInvalidWeight.
+type HashringMutationError struct {
+	// Op is the change that failed: "update", "rehash", or "resize".
+	Op  string
+	Err error
+}
+
+func (e *HashringMutationError) Error() string {
+	return fmt.Sprintf("couldn't %s hashring: %v", e.Op, e.Err)
+}
+
+func (e *HashringMutationError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrHashringMutation.
+func (e *HashringMutationError) Is(target error) bool { return target == ErrHashringMutation }
+
 // NewBuilder allocates a new gRPC balancer.Builder that will route traffic
 // according to a hashring configured with the provided hash function.
 //
@@ -112,25 +554,256 @@ var logger = grpclog.Component("consistenthashring")
 // ```go
 // balancer.Register(consistent.NewBuilder(xxhash.Sum64))
 // ```
-func NewBuilder(hashfn hashring.HashFunc) Builder {
-	return &builder{hashfn: hashfn}
+//
+// BuilderOptions can be provided to further customize the balancer; see the
+// package documentation for an example.
+func NewBuilder(hashfn hashring.HashFunc, opts ...BuilderOption) Builder {
+	b := &builder{
+		hashfn:        hashfn,
+		keyFn:         ContextKeyFunc,
+		memberKeyFn:   DefaultMemberKey,
+		defaultSpread: DefaultSpread,
+		logger:        logger,
+		rand:          intn,
+		rfWarning:     DefaultReplicationFactorWarningThreshold,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// NewBuilderWithKeyFunc allocates a new gRPC balancer.Builder that will route
+// traffic according to a hashring configured with the provided hash function,
+// using keyFn to extract the value to hash from each request.
+//
+// The following is an example usage:
+// ```go
+// balancer.Register(consistent.NewBuilderWithKeyFunc(xxhash.Sum64, consistent.MetadataKeyFunc("x-shard-key")))
+// ```
+func NewBuilderWithKeyFunc(hashfn hashring.HashFunc, keyFn KeyFunc) Builder {
+	return NewBuilder(hashfn, WithKeyFunc(keyFn))
+}
+
+// PickTracer is notified of the backend chosen for each request, such as to
+// record it on the request's trace span.
+//
+// This package doesn't depend on any tracing library, so PickTracer must be
+// adapted to the one in use. For example, with OpenTelemetry:
+// ```go
+// type otelTracer struct{}
+//
+// func (otelTracer) TracePick(ctx context.Context, key []byte, backend string) {
+// trace.SpanFromContext(ctx).SetAttributes(
+// attribute.String("hashring.key", string(key)),
+// attribute.String("hashring.backend", backend),
+// )
+// }
+// ```
+type PickTracer interface {
+	// TracePick is called with the context of the request, the key that was
+	// hashed, and the hashring key of the chosen backend. It's called on
+	// every pick, so it must be fast and safe for concurrent use.
+	TracePick(ctx context.Context, key []byte, backend string)
+}
+
+// KeyFunc extracts the value that will be hashed in order to map a request to
+// the hashring.
+type KeyFunc func(balancer.PickInfo) ([]byte, error)
+
+// ContextKeyFunc is the default KeyFunc. It reads the request key stored in
+// the request's context at CtxKey, which must be a []byte or string.
+func ContextKeyFunc(info balancer.PickInfo) ([]byte, error) {
+	key, ok := RequestKeyFromContext(info.Ctx)
+	if !ok {
+		return nil, fmt.Errorf("request key missing or not []byte or string")
+	}
+
+	return key, nil
+}
+
+// MetadataKeyFunc returns a KeyFunc that reads the request key from the named
+// outgoing gRPC metadata header.
+//
+// For backwards compatibility, a value stored in the request's context at
+// CtxKey takes precedence over the header.
+func MetadataKeyFunc(header string) KeyFunc {
+	return func(info balancer.PickInfo) ([]byte, error) {
+		if info.Ctx.Value(CtxKey) != nil {
+			return ContextKeyFunc(info)
+		}
+
+		md, _ := metadata.FromOutgoingContext(info.Ctx)
+		values := md.Get(header)
+		if len(values) == 0 {
+			return nil, fmt.Errorf("request key missing from metadata header %q", header)
+		}
+
+		return []byte(values[0]), nil
+	}
+}
+
+// CompositeMetadataKeyFunc returns a KeyFunc that forms the request key from
+// several outgoing gRPC metadata headers, such as a tenant and an object type,
+// by joining their values in the given order with sep.
+//
+// A missing header is treated as having an empty value, with its separators
+// kept, so that headers "a", "", and "c" form "a||c" rather than colliding
+// with headers "a", "c", and "". Only when every header is missing is the key
+// missing. Values that contain sep can still collide, so sep should be a
+// string that doesn't appear in the headers' values.
+//
+// Like MetadataKeyFunc, a value stored in the request's context at CtxKey
+// takes precedence over the headers.
+func CompositeMetadataKeyFunc(sep string, headers ...string) KeyFunc {
+	return func(info balancer.PickInfo) ([]byte, error) {
+		if info.Ctx.Value(CtxKey) != nil {
+			return ContextKeyFunc(info)
+		}
+
+		md, _ := metadata.FromOutgoingContext(info.Ctx)
+		var key []byte
+		found := false
+		for i, header := range headers {
+			if i > 0 {
+				key = append(key, sep...)
+			}
+
+			if values := md.Get(header); len(values) > 0 {
+				key = append(key, values[0]...)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("request key missing from metadata headers %q", headers)
+		}
+
+		return key, nil
+	}
+}
+
+// MemberKeyFunc returns the hashring key of a resolved address, which
+// identifies its backend: requests are mapped to backends by the hashes of
+// their keys, so a backend keeps its share of the keys for as long as its key
+// stays the same.
+type MemberKeyFunc func(resolver.Address) string
+
+// DefaultMemberKey is the default MemberKeyFunc. The key of an address without
+// a ServerName, as most resolvers produce, is its Addr. Otherwise, it joins
+// the address's ServerName and Addr with a "/", which can't appear in a server
+// name, so that different addresses never share a key.
+//
+// Earlier versions concatenated ServerName and Addr without the "/", so
+// upgrading moves every backend whose address has a ServerName to a new place
+// in the hashring, which remaps most request keys once. To keep the old
+// placement, use the old keys:
+// ```go
+// consistent.WithMemberKeyFunc(func(addr resolver.Address) string { return addr.ServerName + addr.Addr })
+// ```
+//
+// A blank address, with neither a ServerName nor an Addr, has an empty key,
+// and so is ignored by the balancer like any other address with an empty key.
+func DefaultMemberKey(addr resolver.Address) string {
+	if addr.ServerName == "" {
+		return addr.Addr
+	}
+
+	return addr.ServerName + "/" + addr.Addr
 }
 
 type subConnMember struct {
 	balancer.SubConn
-	key string
+	key    string
+	addrs  []resolver.Address // the addresses the subconn connects to
+	weight uint16
+	stats  *subConnStats
+
+	healthCheck bool // whether the subconn was created with health checking enabled
 }
 
 // Key implements hashring.Member.
 // This value is what will be hashed for placement on the consistent hash ring.
 func (s subConnMember) Key() string { return s.key }
 
-var _ hashring.Member = (*subConnMember)(nil)
+// Weight implements hashring.WeightedMember.
+func (s subConnMember) Weight() uint16 { return s.weight }
+
+var _ hashring.WeightedMember = (*subConnMember)(nil)
+
+// pickResult records that the member was picked and returns a PickResult
+// for its SubConn.
+func (s subConnMember) pickResult() balancer.PickResult {
+	if s.stats == nil {
+		return balancer.PickResult{SubConn: s.SubConn}
+	}
+
+	s.stats.picks.Add(1)
+	s.stats.inFlight.Add(1)
+	if s.stats.totalInFlight != nil {
+		s.stats.totalInFlight.Add(1)
+	}
+
+	return balancer.PickResult{SubConn: s.SubConn, Done: s.stats.done}
+}
+
+// load returns the number of in-flight requests of the member, or 0 if it
+// doesn't track them.
+func (s subConnMember) load() int64 {
+	if s.stats == nil {
+		return 0
+	}
+	return s.stats.inFlight.Load()
+}
+
+// subConnStats tracks the requests the picker has sent to a subconn.
+type subConnStats struct {
+	picks    atomic.Uint64 // number of times Pick has chosen the subconn
+	inFlight atomic.Int64  // number of picked requests that have not completed
+	errors   atomic.Uint64 // number of picked requests that completed with an error
+
+	// totalInFlight is shared by every subconn of a balancer and tracks the
+	// sum of their inFlight counts; may be nil.
+	totalInFlight *atomic.Int64
+
+	// done is allocated once so that returning it from Pick doesn't allocate.
+	done func(balancer.DoneInfo)
+}
+
+func newSubConnStats(totalInFlight *atomic.Int64) *subConnStats {
+	s := &subConnStats{totalInFlight: totalInFlight}
+	s.done = s.onDone
+	return s
+}
+
+func (s *subConnStats) onDone(info balancer.DoneInfo) {
+	s.inFlight.Add(-1)
+	if s.totalInFlight != nil {
+		s.totalInFlight.Add(-1)
+	}
+	if info.Err != nil {
+		s.errors.Add(1)
+	}
+}
 
 type builder struct {
 	sync.Mutex
-	hashfn hashring.HashFunc
-	config BalancerConfig
+	hashfn        hashring.HashFunc
+	keyFn         KeyFunc
+	memberKeyFn   MemberKeyFunc
+	defaultSpread uint8
+	healthCheck   bool
+	logger        Logger
+	rand          func(n uint8) int
+	tracer        PickTracer
+	rejectEmpty   bool
+	onRingEmpty   func(empty bool)
+	rfWarning     uint16 // replication factors above this are logged
+	maxRF         uint16 // replication factors above this are rejected; unlimited when 0
+	config        BalancerConfig
+	lastBalancer  *ringBalancer
 }
 
 // Builder combines both of gRPC's `balancer.Builder` and
@@ -140,20 +813,147 @@ type Builder interface {
 	balancer.ConfigParser
 }
 
-var _ Builder = (*builder)(nil)
+// BalancerTracker is implemented by the Builders returned by NewBuilder, which
+// keep track of the Balancers they build for debugging. It's separate from
+// Builder so that other implementations of Builder don't have to track them.
+//
+// ```go
+// if tracker, ok := builder.(consistent.BalancerTracker); ok && tracker.LastBalancer() != nil {
+// log.Println(tracker.LastBalancer().RingSnapshot())
+// }
+// ```
+type BalancerTracker interface {
+	// LastBalancer returns the most recently built Balancer, or nil if Build
+	// has not yet been called.
+	LastBalancer() Balancer
+}
+
+// Balancer is a gRPC `balancer.Balancer` that exposes its hashring for
+// debugging.
+type Balancer interface {
+	balancer.Balancer
+
+	// RingSnapshot returns the current members of the hashring.
+	//
+	// The returned slice is a copy and is safe to read concurrently with the
+	// balancer's operation.
+	RingSnapshot() []RingMember
+
+	// PickCounts returns the number of times each member of the hashring has
+	// been picked, keyed by member key.
+	PickCounts() map[string]uint64
+
+	// InFlight returns the number of picked requests that have not yet
+	// completed for each member of the hashring, keyed by member key.
+	InFlight() map[string]int64
+
+	// ErrorCounts returns the number of picked requests that completed with an
+	// error for each member of the hashring, keyed by member key.
+	ErrorCounts() map[string]uint64
+
+	// ResetPickCounts sets the pick and error counts of every member of the
+	// hashring to zero.
+	ResetPickCounts()
+
+	// Stats returns the balancer's current metrics, such as to be exported by
+	// a Prometheus collector.
+	Stats() BalancerStats
+
+	// LastRebalance returns when the membership of the hashring last changed
+	// and the keys of the members that were added and removed, sorted, such
+	// as to correlate latency spikes with rebalances. The time is zero if the
+	// membership has never changed.
+	//
+	// It's safe to call concurrently with the balancer's operation.
+	LastRebalance() (at time.Time, added, removed []string)
+}
+
+// BalancerStats is a point-in-time summary of a balancer's activity.
+//
+// Picks and PickErrors only ever increase, so they can be exported as
+// counters; they aren't affected by ResetPickCounts. The per-backend maps
+// only cover the current members of the hashring.
+type BalancerStats struct {
+	// Members is the number of members in the hashring.
+	Members int
+
+	// State is the aggregated connectivity state last reported to gRPC.
+	State connectivity.State
+
+	// Picks is the number of requests the hashring picker has assigned to a
+	// backend.
+	Picks uint64
+
+	// PickErrors is the number of requests the hashring picker failed to
+	// assign to a backend, such as because they had no key. Requests that
+	// wait for a backend to become Ready because of PickWait aren't counted.
+	PickErrors uint64
+
+	// PicksPerBackend is the number of times each backend has been picked,
+	// keyed by member key, as returned by PickCounts.
+	PicksPerBackend map[string]uint64
+
+	// ErrorsPerBackend is the number of picked requests that completed with an
+	// error for each backend, keyed by member key, as returned by ErrorCounts.
+	ErrorsPerBackend map[string]uint64
+}
+
+// pickCounters tracks the picks made by every picker of a balancer.
+type pickCounters struct {
+	picks      atomic.Uint64
+	pickErrors atomic.Uint64
+}
+
+// RingMember describes a single member of a balancer's hashring.
+type RingMember struct {
+	Key          string
+	VirtualNodes uint16
+}
+
+var (
+	_ Builder         = (*builder)(nil)
+	_ BalancerTracker = (*builder)(nil)
+)
 
 func (b *builder) Name() string { return BalancerName }
 
+func (b *builder) LastBalancer() Balancer {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.lastBalancer == nil {
+		return nil
+	}
+
+	return b.lastBalancer
+}
+
 func (b *builder) Build(cc balancer.ClientConn, _ balancer.BuildOptions) balancer.Balancer {
 	bal := &ringBalancer{
-		cc:       cc,
-		subConns: resolver.NewAddressMap(),
-		scStates: make(map[balancer.SubConn]connectivity.State),
-		csEvltr:  &balancer.ConnectivityStateEvaluator{},
-		state:    connectivity.Connecting,
-		hasher:   b.hashfn,
-		picker:   base.NewErrPicker(balancer.ErrNoSubConnAvailable),
+		cc:          cc,
+		subConns:    make(map[string]subConnMember),
+		scStates:    make(map[balancer.SubConn]connectivity.State),
+		connErrs:    make(map[balancer.SubConn]error),
+		csEvltr:     &balancer.ConnectivityStateEvaluator{},
+		state:       connectivity.Connecting,
+		hasher:      b.hashfn,
+		keyFn:       b.keyFn,
+		memberKeyFn: b.memberKeyFn,
+		logger:      b.logger,
+		rand:        b.rand,
+		tracer:      b.tracer,
+		rejectEmpty: b.rejectEmpty,
+		ringEmpty:   true,
+		picker:      base.NewErrPicker(balancer.ErrNoSubConnAvailable),
 	}
+	bal.reportedState.Store(int32(bal.state))
+	if b.onRingEmpty != nil {
+		bal.onRingEmpty = &ringEmptyNotifier{fn: b.onRingEmpty}
+	}
+
+	b.Lock()
+	b.lastBalancer = bal
+	b.Unlock()
 
 	return bal
 }
@@ -164,14 +964,56 @@ func (b *builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingCo
 		return nil, fmt.Errorf("wrr: unable to unmarshal LB policy config: %s, error: %w", string(js), err)
 	}
 
-	logger.Infof("parsed balancer config %s", js)
+	b.logger.Infof("parsed balancer config %s", js)
 
 	if lbCfg.ReplicationFactor == 0 {
 		lbCfg.ReplicationFactor = DefaultReplicationFactor
 	}
 
+	if b.maxRF != 0 && lbCfg.ReplicationFactor > b.maxRF {
+		return nil, fmt.Errorf("invalid replication factor %d in LB policy config: %w", lbCfg.ReplicationFactor, hashring.ErrReplicationFactorTooLarge)
+	}
+
+	if lbCfg.ReplicationFactor > b.rfWarning {
+		b.logger.Warningf("replication factor %d in LB policy config is unusually high and may use a lot of memory", lbCfg.ReplicationFactor)
+	}
+
 	if lbCfg.Spread == 0 {
-		lbCfg.Spread = DefaultSpread
+		lbCfg.Spread = b.defaultSpread
+	}
+
+	if b.healthCheck {
+		lbCfg.EnableHealthCheck = true
+	}
+
+	if lbCfg.EmptyUpdateGrace < 0 {
+		return nil, fmt.Errorf("invalid empty update grace %v in LB policy config: must not be negative", lbCfg.EmptyUpdateGrace)
+	}
+
+	if lbCfg.PickCacheSize < 0 {
+		return nil, fmt.Errorf("invalid pick cache size %d in LB policy config: must not be negative", lbCfg.PickCacheSize)
+	}
+
+	if lbCfg.MaxLoadFactor != 0 && lbCfg.MaxLoadFactor < 1 {
+		return nil, fmt.Errorf("invalid max load factor %v in LB policy config: must be 0 or at least 1", lbCfg.MaxLoadFactor)
+	}
+
+	switch lbCfg.SpreadStrategy {
+	case "", SpreadRandom, SpreadLeastLoaded, SpreadPowerOfTwo:
+	default:
+		return nil, fmt.Errorf("unknown spread strategy %q in LB policy config: %s", lbCfg.SpreadStrategy, string(js))
+	}
+
+	if len(lbCfg.SpreadWeights) > 0 {
+		if err := validateSpreadWeights(&lbCfg); err != nil {
+			return nil, fmt.Errorf("invalid spread weights in LB policy config: %w", err)
+		}
+	}
+
+	if lbCfg.HashFunc != "" {
+		if _, ok := lookupHashFunc(lbCfg.HashFunc); !ok {
+			return nil, fmt.Errorf("unknown hash function %q in LB policy config: %s", lbCfg.HashFunc, string(js))
+		}
 	}
 
 	b.Lock()
@@ -181,29 +1023,123 @@ func (b *builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingCo
 	return &lbCfg, nil
 }
 
+// validateSpreadWeights checks that the SpreadWeights of cfg can be used with
+// its Spread and SpreadStrategy.
+func validateSpreadWeights(cfg *BalancerConfig) error {
+	if len(cfg.SpreadWeights) != int(cfg.Spread) {
+		return fmt.Errorf("got %d weights for a spread of %d", len(cfg.SpreadWeights), cfg.Spread)
+	}
+
+	if cfg.SpreadStrategy != "" && cfg.SpreadStrategy != SpreadRandom {
+		return fmt.Errorf("weights can't be used with spread strategy %q", cfg.SpreadStrategy)
+	}
+
+	sum := 0.0
+	for _, weight := range cfg.SpreadWeights {
+		if !(weight >= 0) || math.IsInf(weight, 0) {
+			return fmt.Errorf("weight %v is not a finite, non-negative number", weight)
+		}
+		sum += weight
+	}
+
+	if math.Abs(sum-1) > 0.001 {
+		return fmt.Errorf("weights sum to %v rather than 1", sum)
+	}
+
+	return nil
+}
+
 type ringBalancer struct {
 	state    connectivity.State
 	cc       balancer.ClientConn
 	picker   balancer.Picker
 	csEvltr  *balancer.ConnectivityStateEvaluator
-	subConns *resolver.AddressMap
+	subConns map[string]subConnMember // keyed by hashring member key
 	scStates map[balancer.SubConn]connectivity.State
 
-	config   *BalancerConfig
-	hashring *hashring.Ring
-	hasher   hashring.HashFunc
+	// mu guards config, hashring, and the last rebalance against concurrent
+	// reads by RingSnapshot and LastRebalance; writes only happen within the
+	// serialized balancer methods.
+	mu          sync.Mutex
+	config      *BalancerConfig
+	hashring    *hashring.Ring
+	rebalanced  time.Time
+	added       []string
+	removed     []string
+	hasher      hashring.HashFunc
+	keyFn       KeyFunc
+	memberKeyFn MemberKeyFunc
+	logger      Logger
+	rand        func(n uint8) int
+	tracer      PickTracer
+	rejectEmpty bool
+	onRingEmpty *ringEmptyNotifier // may be nil
+	ringEmpty   bool               // whether the hashring had no members after the last update
+	inFlight    atomic.Int64       // requests picked but not yet completed across every subconn
+	counters    pickCounters
+
+	// reportedState is the connectivity.State last reported to the
+	// ClientConn, or the initial state if none has been, and is readable
+	// concurrently with the balancer's operation.
+	reportedState atomic.Int32
+
+	resolverErr error                      // the last error reported by the resolver; cleared on successful resolution
+	connErrs    map[balancer.SubConn]error // the last connection error of each subconn; cleared once it's Ready
+
+	// opMu serializes the balancer's methods with graceTimer, which fires
+	// outside of gRPC's serialized calls into the balancer.
+	opMu       sync.Mutex
+	graceTimer *time.Timer // running while serving from the last known hashring after a zero-address update
+}
+
+var _ Balancer = (*ringBalancer)(nil)
+var _ balancer.ExitIdler = (*ringBalancer)(nil)
+
+func (b *ringBalancer) RingSnapshot() []RingMember {
+	b.mu.Lock()
+	ring, config := b.hashring, b.config
+	b.mu.Unlock()
+
+	if ring == nil {
+		return nil
+	}
+
+	members := ring.Members()
+	snapshot := make([]RingMember, 0, len(members))
+	for _, m := range members {
+		weight, err := ring.Weight(m.Key())
+		if err != nil {
+			// m was removed since ring.Members was called.
+			continue
+		}
+
+		snapshot = append(snapshot, RingMember{
+			Key:          m.Key(),
+			VirtualNodes: config.ReplicationFactor * weight,
+		})
+	}
 
-	resolverErr error // the last error reported by the resolver; cleared on successful resolution
-	connErr     error // the last connection error; cleared upon leaving TransientFailure
+	return snapshot
 }
 
-var _ balancer.Balancer = (*ringBalancer)(nil)
+func (b *ringBalancer) LastRebalance() (time.Time, []string, []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rebalanced, b.added, b.removed
+}
 
 func (b *ringBalancer) ResolverError(err error) {
+	b.opMu.Lock()
+	defer b.opMu.Unlock()
+
+	b.resolverError(err)
+}
+
+func (b *ringBalancer) resolverError(err error) {
 	b.resolverErr = err
-	if b.subConns.Len() == 0 {
+	if len(b.subConns) == 0 {
 		b.state = connectivity.TransientFailure
-		b.picker = base.NewErrPicker(errors.Join(b.connErr, b.resolverErr))
 	}
 
 	if b.state != connectivity.TransientFailure {
@@ -212,95 +1148,312 @@ func (b *ringBalancer) ResolverError(err error) {
 		return
 	}
 
-	b.cc.UpdateState(balancer.State{
-		ConnectivityState: b.state,
-		Picker:            b.picker,
-	})
+	b.regeneratePicker()
+
+	b.updateState()
 }
 
-// UpdateClientConnState is called when there are changes in the Address set or
-// Service Config that the balancer may want to react to.
-//
-// In this case, the hashring is updated and a new picker using that hashring
-// is generated.
-func (b *ringBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
-	if logger.V(2) {
-		logger.Info("got new ClientConn state: ", s)
+func (b *ringBalancer) PickCounts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, m := range b.ringMembers() {
+		if member := m.(subConnMember); member.stats != nil {
+			counts[member.key] = member.stats.picks.Load()
+		}
 	}
-	// Successful resolution: clear resolver error and ensure we return nil.
-	b.resolverErr = nil
 
-	// update the service config if it has changed
+	return counts
+}
+
+func (b *ringBalancer) InFlight() map[string]int64 {
+	inFlight := make(map[string]int64)
+	for _, m := range b.ringMembers() {
+		if member := m.(subConnMember); member.stats != nil {
+			inFlight[member.key] = member.stats.inFlight.Load()
+		}
+	}
+
+	return inFlight
+}
+
+func (b *ringBalancer) ErrorCounts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, m := range b.ringMembers() {
+		if member := m.(subConnMember); member.stats != nil {
+			counts[member.key] = member.stats.errors.Load()
+		}
+	}
+
+	return counts
+}
+
+func (b *ringBalancer) Stats() BalancerStats {
+	stats := BalancerStats{
+		State:            connectivity.State(b.reportedState.Load()),
+		Picks:            b.counters.picks.Load(),
+		PickErrors:       b.counters.pickErrors.Load(),
+		PicksPerBackend:  make(map[string]uint64),
+		ErrorsPerBackend: make(map[string]uint64),
+	}
+
+	members := b.ringMembers()
+	stats.Members = len(members)
+	for _, m := range members {
+		if member := m.(subConnMember); member.stats != nil {
+			stats.PicksPerBackend[member.key] = member.stats.picks.Load()
+			stats.ErrorsPerBackend[member.key] = member.stats.errors.Load()
+		}
+	}
+
+	return stats
+}
+
+func (b *ringBalancer) ResetPickCounts() {
+	for _, m := range b.ringMembers() {
+		if member := m.(subConnMember); member.stats != nil {
+			member.stats.picks.Store(0)
+			member.stats.errors.Store(0)
+		}
+	}
+}
+
+// ringMembers returns the members of the current hashring, and is safe to call
+// concurrently with the balancer's operation.
+func (b *ringBalancer) ringMembers() []hashring.Member {
+	b.mu.Lock()
+	ring := b.hashring
+	b.mu.Unlock()
+
+	if ring == nil {
+		return nil
+	}
+
+	return ring.Members()
+}
+
+// UpdateClientConnState is called when there are changes in the Endpoint set or
+// Service Config that the balancer may want to react to.
+//
+// In this case, the hashring is updated and a new picker using that hashring
+// is generated.
+func (b *ringBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.opMu.Lock()
+	defer b.opMu.Unlock()
+
+	return b.updateClientConnState(s, true)
+}
+
+// updateClientConnState applies s, and if allowGrace, keeps serving from the
+// last known hashring when s has zero addresses and EmptyUpdateGrace is set.
+func (b *ringBalancer) updateClientConnState(s balancer.ClientConnState, allowGrace bool) error {
+	if b.logger.V(2) {
+		b.logger.Infof("got new ClientConn state: %v", s)
+	}
+	// Successful resolution: clear resolver error and ensure we return nil.
+	b.resolverErr = nil
+
+	// update the service config if it has changed
 	if s.BalancerConfig != nil {
 		svcConfig := s.BalancerConfig.(*BalancerConfig)
-		if b.config == nil || svcConfig.ReplicationFactor != b.config.ReplicationFactor {
-			b.hashring = hashring.MustNew(b.hasher, svcConfig.ReplicationFactor)
-			b.config = svcConfig
+
+		hasher := b.hasher
+		if svcConfig.HashFunc != "" {
+			var ok bool
+			if hasher, ok = lookupHashFunc(svcConfig.HashFunc); !ok {
+				return fmt.Errorf("unknown hash function %q", svcConfig.HashFunc)
+			}
+		}
+
+		ring := b.hashring
+		switch {
+		case ring == nil:
+			ring = hashring.MustNew(hasher, svcConfig.ReplicationFactor)
+		case svcConfig.HashFunc != b.config.HashFunc:
+			// the hash function of a hashring is fixed, so the existing members
+			// are moved into a new hashring
+			rehashed := hashring.MustNew(hasher, svcConfig.ReplicationFactor)
+			for _, m := range ring.Members() {
+				weight, err := ring.Weight(m.Key())
+				if err != nil {
+					return &HashringMutationError{Op: "rehash", Err: err}
+				}
+				if err := rehashed.AddWeighted(m, weight); err != nil {
+					return &HashringMutationError{Op: "rehash", Err: err}
+				}
+			}
+			ring = rehashed
+		case svcConfig.ReplicationFactor != b.config.ReplicationFactor:
+			// resizing keeps the existing members in the hashring
+			if err := ring.SetReplicationFactor(svcConfig.ReplicationFactor); err != nil {
+				return &HashringMutationError{Op: "resize", Err: err}
+			}
 		}
+
+		b.mu.Lock()
+		b.hashring = ring
+		b.config = svcConfig
+		b.mu.Unlock()
 	}
 
 	// if there's no hashring yet, the balancer hasn't yet parsed an initial
 	// service config with settings
 	if b.hashring == nil {
-		b.picker = base.NewErrPicker(errors.Join(b.connErr, b.resolverErr))
-		b.cc.UpdateState(balancer.State{ConnectivityState: b.state, Picker: b.picker})
+		b.regeneratePicker()
+		b.updateState()
 
 		return fmt.Errorf("no hashring configured")
 	}
 
-	// Look through the set of addresses the resolver has passed to the balancer
-	// if any new targets have been added, they are added to the hashring, and
-	// any that have been removed since the last update are removed from the
-	// hashring.
-	addrsSet := resolver.NewAddressMap()
-	for _, addr := range s.ResolverState.Addresses {
-		addrsSet.Set(addr, nil)
+	// Build the full set of members from the endpoints the resolver has
+	// passed to the balancer, creating subconns for any new endpoints, and
+	// swap it into the hashring in one step, so that pickers never see a mix
+	// of the old and new members. Each endpoint is a single member with a
+	// single subconn, however many addresses it has.
+	endpoints := resolvedEndpoints(s.ResolverState)
+	if len(endpoints) == 0 && allowGrace && b.config.EmptyUpdateGrace > 0 && len(b.subConns) > 0 {
+		return b.startEmptyUpdateGrace()
+	}
+	if b.graceTimer != nil {
+		b.graceTimer.Stop()
+		b.graceTimer = nil
+	}
+
+	healthCheck := b.config.HealthCheckEnabled || b.config.EnableHealthCheck
+	members := make([]hashring.Member, 0, len(endpoints))
+	added := make(map[string]subConnMember)
+	endpointsSet := make(map[string]struct{}, len(endpoints))
+	for _, ep := range endpoints {
+		if len(ep.Addresses) == 0 {
+			b.logger.Warningf("ignoring endpoint without addresses")
+			continue
+		}
+
+		// A misbehaving resolver may list an address twice in an endpoint,
+		// which would otherwise give it a different key than the same
+		// endpoint listed properly.
+		if addrs, duplicates := uniqueAddresses(ep.Addresses, b.memberKeyFn); len(duplicates) > 0 {
+			b.logger.Warningf("ignoring duplicate addresses %q of endpoint %v", duplicates, ep.Addresses)
+			ep.Addresses = addrs
+		}
 
-		if _, ok := b.subConns.Get(addr); !ok {
-			// addr is addr new address (not existing in b.subConns).
-			sc, err := b.cc.NewSubConn([]resolver.Address{addr}, balancer.NewSubConnOptions{HealthCheckEnabled: false})
+		key := endpointKey(ep, b.memberKeyFn)
+		if key == "" {
+			// The hashring rejects empty keys, which usually come from a
+			// misconfigured resolver.
+			b.logger.Warningf("ignoring endpoint %v: its hashring member key is empty", ep.Addresses)
+			continue
+		}
+		if _, ok := endpointsSet[key]; ok {
+			// Another endpoint already has the same hashring key, such as
+			// one whose addresses only differ in their attributes.
+			b.logger.Warningf("ignoring endpoint %v: hashring member %q already exists", ep.Addresses, key)
+			continue
+		}
+		weight := endpointWeight(ep)
+		if uint32(weight)*uint32(b.hashring.ReplicationFactor()) > math.MaxUint16 {
+			// The hashring would reject the member, and with it the rest of
+			// the update, since its weight gives it too many vnodes.
+			b.logger.Warningf("ignoring endpoint %v: its weight %d gives it too many vnodes at replication factor %d", ep.Addresses, weight, b.hashring.ReplicationFactor())
+			continue
+		}
+
+		member, ok := b.subConns[key]
+		if !ok || !sameTargets(member.addrs, ep.Addresses) || member.healthCheck != healthCheck {
+			sc, err := b.cc.NewSubConn(ep.Addresses, balancer.NewSubConnOptions{HealthCheckEnabled: healthCheck})
 			if err != nil {
-				logger.Warningf("base.baseBalancer: failed to create new SubConn: %v", err)
+				b.logger.Warningf("base.baseBalancer: failed to create new SubConn: %v", err)
 				continue
 			}
 
-			b.subConns.Set(addr, sc)
-			b.scStates[sc] = connectivity.Idle
-			b.csEvltr.RecordTransition(connectivity.Shutdown, connectivity.Idle)
-			sc.Connect()
+			stats := member.stats
+			if !ok {
+				stats = newSubConnStats(&b.inFlight)
+			}
 
-			if err := b.hashring.Add(subConnMember{
-				SubConn: sc,
-				key:     addr.ServerName + addr.Addr,
-			}); err != nil {
-				return fmt.Errorf("couldn't add to hashring")
+			// A member whose addresses changed, such as when a MemberKeyFunc
+			// identifies backends by something other than their address, or
+			// whose subconn was created before health checking was turned on
+			// or off, keeps its place in the hashring and its stats, but
+			// connects through a new subconn, since the options of a subconn
+			// can't be changed.
+			member = subConnMember{
+				SubConn:     sc,
+				key:         key,
+				addrs:       ep.Addresses,
+				stats:       stats,
+				healthCheck: healthCheck,
 			}
+			added[key] = member
 		}
+		endpointsSet[key] = struct{}{}
+
+		member.weight = weight
+		members = append(members, member)
 	}
 
-	for _, addr := range b.subConns.Keys() {
-		sci, _ := b.subConns.Get(addr)
-		sc := sci.(balancer.SubConn)
-		// addr was removed by resolver.
-		if _, ok := addrsSet.Get(addr); !ok {
-			b.cc.RemoveSubConn(sc)
-			b.subConns.Delete(addr)
+	if err := b.hashring.ReplaceAll(members); err != nil {
+		// Nothing else knows about the new subconns yet, so removing them is
+		// enough to keep them from leaking.
+		for _, member := range added {
+			b.cc.RemoveSubConn(member.SubConn)
+		}
+		return &HashringMutationError{Op: "update", Err: err}
+	}
+
+	var joined, left []string
+	for _, m := range members {
+		member := m.(subConnMember)
+		replaced, ok := b.subConns[member.key]
+		if !ok {
+			joined = append(joined, member.key)
+		} else if replaced.SubConn != member.SubConn {
+			// Keep the state of the replaced sc in b.scStates until its state
+			// becomes Shutdown, like any other removed sc.
+			b.cc.RemoveSubConn(replaced.SubConn)
+		}
+		b.subConns[member.key] = member
+
+		if _, ok := added[member.key]; ok {
+			// The subconn starts connecting right away, and the aggregate
+			// state reflects that, so that a TransientFailure reported before
+			// there were any subconns doesn't outlast them.
+			b.scStates[member.SubConn] = connectivity.Connecting
+			b.state = b.csEvltr.RecordTransition(connectivity.Shutdown, connectivity.Connecting)
+			member.Connect()
+		}
+	}
+
+	for key, member := range b.subConns {
+		// The endpoint was removed by the resolver.
+		if _, ok := endpointsSet[key]; !ok {
+			b.cc.RemoveSubConn(member.SubConn)
+			delete(b.subConns, key)
+			left = append(left, key)
 			// Keep the state of this sc in b.scStates until sc's state becomes Shutdown.
 			// The entry will be deleted in UpdateSubConnState.
-			if err := b.hashring.Remove(subConnMember{
-				SubConn: sc,
-				key:     addr.ServerName + addr.Addr,
-			}); err != nil {
-				return fmt.Errorf("couldn't add to hashring")
-			}
 		}
 	}
 
-	if logger.V(2) {
-		logger.Infof("%d hashring members found", len(b.hashring.Members()))
+	if len(joined) > 0 || len(left) > 0 {
+		sort.Strings(joined)
+		sort.Strings(left)
+
+		b.mu.Lock()
+		b.rebalanced, b.added, b.removed = time.Now(), joined, left
+		b.mu.Unlock()
+	}
+
+	if empty := b.hashring.Size() == 0; empty != b.ringEmpty {
+		b.ringEmpty = empty
+		if b.onRingEmpty != nil {
+			b.onRingEmpty.notify(empty)
+		}
+	}
+
+	if b.logger.V(2) {
+		b.logger.Infof("%d hashring members found", b.hashring.Size())
 
 		for _, m := range b.hashring.Members() {
-			logger.Infof("hashring member %s", m.Key())
+			b.logger.Infof("hashring member %s", m.Key())
 		}
 	}
 
@@ -308,41 +1461,70 @@ func (b *ringBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
 	// will trigger re-resolve. Also records this as addr resolver error, so when
 	// the overall state turns transient failure, the error message will have
 	// the zero address information.
-	if len(s.ResolverState.Addresses) == 0 {
-		b.ResolverError(errors.New("produced zero addresses"))
+	if len(endpoints) == 0 {
+		b.resolverError(ErrZeroAddresses)
 		return balancer.ErrBadResolverState
 	}
 
-	// If the overall connection state is not in transient failure, we return
-	// addr new picker with addr reference to the hashring (otherwise an error picker)
-	if b.state == connectivity.TransientFailure {
-		b.picker = base.NewErrPicker(errors.Join(b.connErr, b.resolverErr))
-	} else {
-		b.picker = &picker{
-			hashring: b.hashring,
-			spread:   b.config.Spread,
-		}
-	}
+	b.regeneratePicker()
 
 	// update the ClientConn with the current hashring picker picker
-	b.cc.UpdateState(balancer.State{ConnectivityState: b.state, Picker: b.picker})
+	b.updateState()
 
 	return nil
 }
 
+// startEmptyUpdateGrace keeps the current subconns and hashring after a
+// zero-address update until EmptyUpdateGrace passes, measured from the first
+// of any consecutive zero-address updates, or the resolver returns addresses
+// again.
+func (b *ringBalancer) startEmptyUpdateGrace() error {
+	if b.graceTimer == nil {
+		b.logger.Warningf("resolver produced zero addresses, serving from the last %d known addresses for %v", len(b.subConns), b.config.EmptyUpdateGrace)
+
+		var timer *time.Timer
+		timer = time.AfterFunc(b.config.EmptyUpdateGrace, func() {
+			b.opMu.Lock()
+			defer b.opMu.Unlock()
+
+			if b.graceTimer != timer {
+				// The resolver returned addresses in the meantime.
+				return
+			}
+			b.graceTimer = nil
+
+			b.logger.Warningf("resolver still produced zero addresses after %v", b.config.EmptyUpdateGrace)
+			_ = b.updateClientConnState(balancer.ClientConnState{}, false)
+		})
+		b.graceTimer = timer
+	}
+
+	// Record the error in case every subconn fails in the meantime, and apply
+	// any new config to the picker, but leave the state as it is.
+	b.resolverErr = ErrZeroAddresses
+	b.regeneratePicker()
+	b.updateState()
+
+	// Ask the resolver to try again.
+	return balancer.ErrBadResolverState
+}
+
 // UpdateSubConnState is called when there's a change in a subconnection state.
 // Subconnection state can affect the overall state of the balancer.
 // This also attempts to reconnect any idle connections.
 func (b *ringBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	b.opMu.Lock()
+	defer b.opMu.Unlock()
+
 	s := state.ConnectivityState
-	if logger.V(2) {
-		logger.Infof("base.baseBalancer: handle SubConn state change: %p, %v", sc, s)
+	if b.logger.V(2) {
+		b.logger.Infof("base.baseBalancer: handle SubConn state change: %p, %v", sc, s)
 	}
 
 	oldS, ok := b.scStates[sc]
 	if !ok {
-		if logger.V(2) {
-			logger.Infof("base.baseBalancer: got state changes for an unknown SubConn: %p, %v", sc, s)
+		if b.logger.V(2) {
+			b.logger.Infof("base.baseBalancer: got state changes for an unknown SubConn: %p, %v", sc, s)
 		}
 
 		return
@@ -365,60 +1547,639 @@ func (b *ringBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.Su
 	switch s {
 	case connectivity.Idle:
 		sc.Connect()
+	case connectivity.Ready:
+		delete(b.connErrs, sc)
 	case connectivity.Shutdown:
 		// When an address was removed by resolver, b called RemoveSubConn but
 		// kept the sc's state in scStates. Remove state for this sc here.
 		delete(b.scStates, sc)
+		delete(b.connErrs, sc)
 	case connectivity.TransientFailure:
 		// Save error to be reported via picker.
-		b.connErr = state.ConnectionError
+		if state.ConnectionError != nil {
+			b.connErrs[sc] = state.ConnectionError
+		}
 	}
 
 	b.state = b.csEvltr.RecordTransition(oldS, s)
 
+	b.regeneratePicker()
+
+	b.updateState()
+}
+
+// transientFailureErr returns the error reported by the picker while the
+// balancer is in TransientFailure: the last connection error of each backend
+// that has failed, naming the backend, along with the last resolver error.
+func (b *ringBalancer) transientFailureErr() error {
+	keys := make([]string, 0, len(b.connErrs))
+	for key, member := range b.subConns {
+		if _, ok := b.connErrs[member.SubConn]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	errs := make([]error, 0, len(keys)+1)
+	for _, key := range keys {
+		errs = append(errs, fmt.Errorf("%s: %w", key, b.connErrs[b.subConns[key].SubConn]))
+	}
+	errs = append(errs, b.resolverErr)
+
+	return errors.Join(errs...)
+}
+
+// ExitIdle asks every idle subconnection to reconnect so that the first pick
+// after the channel leaves idleness doesn't have to wait on a backend that
+// went idle in the meantime.
+func (b *ringBalancer) ExitIdle() {
+	b.opMu.Lock()
+	defer b.opMu.Unlock()
+
+	connecting := false
+	for sc, state := range b.scStates {
+		if state != connectivity.Idle {
+			continue
+		}
+
+		sc.Connect()
+		b.scStates[sc] = connectivity.Connecting
+		b.state = b.csEvltr.RecordTransition(connectivity.Idle, connectivity.Connecting)
+		connecting = true
+	}
+
+	if !connecting || b.picker == nil {
+		return
+	}
+
+	b.regeneratePicker()
+
+	b.updateState()
+}
+
+// updateState reports the aggregated connectivity state and the current
+// picker to the ClientConn.
+func (b *ringBalancer) updateState() {
+	b.reportedState.Store(int32(b.state))
 	b.cc.UpdateState(balancer.State{ConnectivityState: b.state, Picker: b.picker})
 }
 
+// regeneratePicker replaces the current picker with one that reflects the
+// current state of the balancer: an error picker while the balancer is in
+// TransientFailure or has no hashring, and a hashring picker with a fresh
+// view of which subconns are ready otherwise.
+func (b *ringBalancer) regeneratePicker() {
+	if b.state == connectivity.TransientFailure || b.hashring == nil {
+		b.picker = base.NewErrPicker(b.transientFailureErr())
+		return
+	}
+
+	b.picker = b.newPicker()
+}
+
+// newPicker allocates a picker over the current hashring and config.
+func (b *ringBalancer) newPicker() *picker {
+	p := &picker{
+		hashring:    b.hashring,
+		spread:      b.config.Spread,
+		keyFn:       b.keyFn,
+		rand:        b.rand,
+		tracer:      b.tracer,
+		rejectEmpty: b.rejectEmpty,
+		counters:    &b.counters,
+	}
+
+	if b.config.FallbackToNext || b.config.EnableHealthCheck || b.config.PickWait {
+		p.ready = make(map[balancer.SubConn]struct{}, len(b.scStates))
+		for sc, state := range b.scStates {
+			if state == connectivity.Ready {
+				p.ready[sc] = struct{}{}
+			}
+		}
+	}
+
+	p.preferReady = b.config.EnableHealthCheck
+	p.fallbackToNext = b.config.FallbackToNext
+	p.wait = b.config.PickWait
+	p.spreadStrategy = b.config.SpreadStrategy
+	p.spreadWeights = b.config.SpreadWeights
+
+	if b.config.MaxLoadFactor > 0 {
+		p.maxLoadFactor = b.config.MaxLoadFactor
+		p.totalInFlight = &b.inFlight
+	}
+
+	if b.config.PickCacheSize > 0 {
+		p.cache = newPickCache(b.config.PickCacheSize)
+	}
+
+	members := b.hashring.Size()
+	if members > math.MaxUint8 {
+		members = math.MaxUint8
+	}
+	p.numMembers = uint8(members)
+
+	return p
+}
+
 func (b *ringBalancer) Close() {
-	// No internal state to clean up and no need to call RemoveSubConn.
+	b.opMu.Lock()
+	defer b.opMu.Unlock()
+
+	// No need to call RemoveSubConn, but a zero-address update must not fail
+	// the closed balancer later.
+	if b.graceTimer != nil {
+		b.graceTimer.Stop()
+		b.graceTimer = nil
+	}
+}
+
+// ringEmptyNotifier calls fn with each transition of a balancer's hashring to
+// or from empty, off of the balancer's goroutine so that a slow fn doesn't
+// hold up resolver updates, but one at a time and in the order they happened.
+type ringEmptyNotifier struct {
+	fn func(empty bool)
+
+	mu      sync.Mutex
+	pending []bool // transitions not yet passed to fn
+	running bool   // whether a goroutine is delivering pending
+}
+
+// notify queues a call to fn with empty, starting a goroutine to deliver it
+// unless one is already delivering earlier transitions.
+func (n *ringEmptyNotifier) notify(empty bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.pending = append(n.pending, empty)
+	if !n.running {
+		n.running = true
+		go n.deliver()
+	}
+}
+
+// deliver calls fn with each pending transition until there are none left.
+func (n *ringEmptyNotifier) deliver() {
+	for {
+		n.mu.Lock()
+		if len(n.pending) == 0 {
+			n.running = false
+			n.mu.Unlock()
+			return
+		}
+		empty := n.pending[0]
+		n.pending = n.pending[1:]
+		n.mu.Unlock()
+
+		n.fn(empty)
+	}
 }
 
 type picker struct {
-	hashring *hashring.Ring
-	spread   uint8
+	hashring    hashring.Hasher
+	numMembers  uint8 // number of hashring members, capped at math.MaxUint8
+	spread      uint8
+	keyFn       KeyFunc           // ContextKeyFunc is used when nil
+	rand        func(n uint8) int // returns a number in [0,n); intn is used when nil
+	tracer      PickTracer        // may be nil
+	rejectEmpty bool              // return ErrEmptyKey rather than hashing an empty key
+
+	spreadStrategy SpreadStrategy                // how spread candidates are chosen; SpreadRandom is used when empty
+	spreadWeights  []float64                     // the odds of choosing each spread candidate; uniform when nil
+	preferReady    bool                          // prefer Ready subconns among the spread candidates
+	fallbackToNext bool                          // consider every member when the chosen one isn't Ready
+	wait           bool                          // return balancer.ErrNoSubConnAvailable when the chosen one isn't Ready
+	ready          map[balancer.SubConn]struct{} // subconns that were Ready when the picker was built
+
+	maxLoadFactor float64       // skip members loaded beyond this multiple of the average; disabled when 0
+	totalInFlight *atomic.Int64 // in-flight requests across every member; set along with maxLoadFactor
+
+	counters *pickCounters // may be nil
+	cache    *pickCache    // candidates of recently picked keys; may be nil
 }
 
 var _ balancer.Picker = (*picker)(nil)
 
+// pickCache is an LRU cache of the candidates found along the hashring for
+// request keys, which is safe for concurrent use.
+type pickCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element // values are *pickCacheEntry
+	order   *list.List               // most recently used first
+}
+
+type pickCacheEntry struct {
+	key     string
+	members []hashring.Member // never modified once cached
+}
+
+func newPickCache(size int) *pickCache {
+	return &pickCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// get returns the num candidates cached for key, if any. A nil cache is empty.
+func (c *pickCache) get(key []byte, num uint8) ([]hashring.Member, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[string(key)]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*pickCacheEntry)
+	if len(entry.members) != int(num) {
+		// The request overrode the spread.
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	return entry.members, true
+}
+
+// add caches members as the candidates for key, evicting the least recently
+// used key if the cache is full. Adding to a nil cache does nothing.
+func (c *pickCache) add(key []byte, members []hashring.Member) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[string(key)]; ok {
+		element.Value.(*pickCacheEntry).members = members
+		c.order.MoveToFront(element)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*pickCacheEntry).key)
+	}
+
+	entry := &pickCacheEntry{key: string(key), members: members}
+	c.entries[entry.key] = c.order.PushFront(entry)
+}
+
 // Pick returns a subconnection to use for a request based on the request info.
 //
-// The value stored in CtxKey is hashed into the hashring, and the resulting
-// subconnection is used.
+// The key returned by the picker's KeyFunc (by default, the value stored in
+// CtxKey) is hashed into the hashring, and the resulting subconnection is used.
+// If no key can be extracted from the request, an error with the Internal gRPC
+// status code is returned, which fails the RPC without retrying it. An empty
+// key is hashed like any other, so every request with one is sent to the same
+// subconnection, unless WithRejectEmptyKeys is used.
 //
-// There is no fallback behavior if the subconnection is unavailable; this
-// prevents the request from going to a node that doesn't expect to receive it.
-// As long as you are using a resolver that removes connections from the list
-// when they are observably unavailable, this is a non-issue.
+// By default, there is no fallback behavior if the subconnection is
+// unavailable; this prevents the request from going to a node that doesn't
+// expect to receive it. As long as you are using a resolver that removes
+// connections from the list when they are observably unavailable, this is a
+// non-issue. If FallbackToNext is configured, the next Ready subconnection
+// along the hashring is used instead; if none are Ready, the originally chosen
+// subconnection is returned.
 //
 // Spread can be increased to be robust against single node availability
 // problems. If spread is greater than 1, a random selection is made from the
-// set of subconns matching the hash.
+// set of subconns matching the hash. The configured spread can be overridden
+// for a single request with ContextWithSpread. If EnableHealthCheck is configured, the
+// selection is made from the Ready subconns in that set, if there are any. A
+// spread greater than the number of subconns selects from all of them.
 func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
-	key := info.Ctx.Value(CtxKey).([]byte)
+	result, err := p.pick(info)
+	if p.counters != nil && err != balancer.ErrNoSubConnAvailable {
+		if err != nil {
+			p.counters.pickErrors.Add(1)
+		} else {
+			p.counters.picks.Add(1)
+		}
+	}
 
-	members, err := p.hashring.FindN(key, p.spread)
+	return result, err
+}
+
+// keyError gives err, an error extracting the request key, the Internal gRPC
+// status code, unless it already has a status.
+//
+// gRPC fails RPCs immediately with the status of a status error returned by a
+// picker, without retrying them or waiting for a new picker, even for
+// wait-for-ready RPCs, which suits requests that have no usable key. Errors
+// from the hashring, such as hashring.ErrNotEnoughMembers, are deliberately
+// left without a status: for those, gRPC fails RPCs with Unavailable, which
+// retry policies can retry, and lets wait-for-ready RPCs wait for members.
+//
+// The returned error wraps err, so it can still be matched with errors.Is.
+func keyError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return &statusError{code: codes.Internal, err: err}
+}
+
+// statusError is an error with a gRPC status code that wraps another error.
+type statusError struct {
+	code codes.Code
+	err  error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+
+func (e *statusError) Unwrap() error { return e.err }
+
+// GRPCStatus returns the gRPC status of the error, which is what gRPC fails
+// RPCs with.
+func (e *statusError) GRPCStatus() *status.Status { return status.New(e.code, e.err.Error()) }
+
+func (p *picker) pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	keyFn := p.keyFn
+	if keyFn == nil {
+		keyFn = ContextKeyFunc
+	}
+
+	key, err := keyFn(info)
 	if err != nil {
-		return balancer.PickResult{}, err
+		return balancer.PickResult{}, keyError(err)
+	}
+	if p.rejectEmpty && len(key) == 0 {
+		return balancer.PickResult{}, keyError(ErrEmptyKey)
+	}
+
+	spread := p.spread
+	if override, ok := info.Ctx.Value(SpreadKey).(uint8); ok {
+		spread = override
+		if spread < 1 {
+			spread = 1
+		}
+	}
+
+	// A spread larger than the hashring degrades to using every member rather
+	// than failing every pick.
+	if spread > p.numMembers && p.numMembers > 0 {
+		spread = p.numMembers
+	}
+
+	replicas, _ := info.Ctx.Value(ReplicasKey).(*Replicas)
+	replica, pinned := info.Ctx.Value(ReplicaKey).(uint8)
+
+	if spread == 1 && replicas == nil && p.cache == nil && !p.fallbackToNext && p.maxLoadFactor == 0 {
+		member, err := p.hashring.Find(key)
+		if err != nil {
+			return balancer.PickResult{}, err
+		}
+
+		return p.pickResult(info, key, member.(subConnMember))
+	}
+
+	members, ok := p.cache.get(key, spread)
+	if !ok {
+		members, err = p.hashring.FindN(key, spread)
+		if err != nil {
+			return balancer.PickResult{}, err
+		}
+		p.cache.add(key, members)
+	}
+
+	if replicas != nil {
+		replicas.record(members[:spread])
+	}
+	if pinned {
+		return p.pickResult(info, key, members[int(replica)%int(spread)].(subConnMember))
 	}
 
 	index := 0
-	if p.spread > 1 {
-		index = intn(p.spread)
+	if spread > 1 {
+		index = p.spreadIndex(members[:spread])
 	}
 
 	chosen := members[index].(subConnMember)
 
-	return balancer.PickResult{SubConn: chosen.SubConn}, nil
+	if p.fallbackToNext || p.maxLoadFactor > 0 {
+		// Candidates are tried in hashring order from the chosen one, wrapping
+		// around to those before it. The members beyond those found are only
+		// found if none of them will do, since finding every member is far
+		// slower than finding a few.
+		loadLimit := p.loadLimit()
+		candidate, ok := p.firstAcceptable(members[index:], loadLimit)
+		if !ok && int(p.numMembers) > len(members) {
+			all, err := p.hashring.FindN(key, p.numMembers)
+			if err != nil {
+				return balancer.PickResult{}, err
+			}
+			candidate, ok = p.firstAcceptable(all[len(members):], loadLimit)
+		}
+		if !ok {
+			candidate, ok = p.firstAcceptable(members[:index], loadLimit)
+		}
+		if ok {
+			chosen = candidate
+		}
+	}
+
+	return p.pickResult(info, key, chosen)
+}
+
+// firstAcceptable returns the first of candidates that's Ready, if the picker
+// falls back to the next member, and has fewer than loadLimit requests in
+// flight.
+func (p *picker) firstAcceptable(candidates []hashring.Member, loadLimit int64) (subConnMember, bool) {
+	for _, member := range candidates {
+		candidate := member.(subConnMember)
+		if p.fallbackToNext {
+			if _, ok := p.ready[candidate.SubConn]; !ok {
+				continue
+			}
+		}
+		if candidate.stats != nil && candidate.stats.inFlight.Load() >= loadLimit {
+			continue
+		}
+
+		return candidate, true
+	}
+
+	return subConnMember{}, false
+}
+
+// pickResult records the pick of chosen for the request with the given key,
+// unless the picker waits for chosen to become Ready.
+func (p *picker) pickResult(info balancer.PickInfo, key []byte, chosen subConnMember) (balancer.PickResult, error) {
+	if p.wait && !p.isReady(chosen) {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	if p.tracer != nil {
+		p.tracer.TracePick(info.Ctx, key, chosen.key)
+	}
+
+	return chosen.pickResult(), nil
+}
+
+// loadLimit returns the number of in-flight requests at which a member is
+// considered overloaded when using bounded loads: MaxLoadFactor times the
+// average load once the request being picked is included.
+func (p *picker) loadLimit() int64 {
+	if p.maxLoadFactor == 0 || p.totalInFlight == nil || p.numMembers == 0 {
+		return math.MaxInt64
+	}
+
+	average := float64(p.totalInFlight.Load()+1) / float64(p.numMembers)
+	return int64(math.Ceil(p.maxLoadFactor * average))
+}
+
+// intn returns, as an int, a non-negative pseudo-random number in the
+// half-open interval [0,n) using the picker's random number generator.
+func (p *picker) intn(n uint8) int {
+	if p.rand == nil {
+		return intn(n)
+	}
+	return p.rand(n)
+}
+
+// float64 returns a pseudo-random number in the half-open interval [0,1) using
+// the picker's random number generator. The generator only returns numbers
+// below 256, so several of them are combined as the digits of a base-255
+// fraction, which is fine-grained enough for choosing by weight.
+func (p *picker) float64() float64 {
+	f := 0.0
+	for i := 0; i < 6; i++ {
+		f = (f + float64(p.intn(255))) / 255
+	}
+	return f
+}
+
+// spreadIndex selects the index of one of the candidates according to the
+// picker's SpreadStrategy, only considering Ready candidates when the picker
+// is configured to prefer them and there are any.
+func (p *picker) spreadIndex(candidates []hashring.Member) int {
+	readyOnly := false
+	eligible := len(candidates)
+	if p.preferReady {
+		numReady := 0
+		for _, candidate := range candidates {
+			if p.isReady(candidate.(subConnMember)) {
+				numReady++
+			}
+		}
+
+		if numReady > 0 {
+			readyOnly = true
+			eligible = numReady
+		}
+	}
+
+	switch p.spreadStrategy {
+	case SpreadLeastLoaded:
+		// Start the scan at a random candidate so that ties are broken at
+		// random.
+		start := p.intn(uint8(len(candidates)))
+		chosen, chosenLoad := -1, int64(0)
+		for i := range candidates {
+			index := (start + i) % len(candidates)
+			candidate := candidates[index].(subConnMember)
+			if readyOnly && !p.isReady(candidate) {
+				continue
+			}
+
+			if load := candidate.load(); chosen < 0 || load < chosenLoad {
+				chosen, chosenLoad = index, load
+			}
+		}
+		return chosen
+	case SpreadPowerOfTwo:
+		if eligible == 1 {
+			return p.nthEligible(candidates, 0, readyOnly)
+		}
+
+		first := p.intn(uint8(eligible))
+		second := p.intn(uint8(eligible - 1))
+		if second >= first {
+			second++
+		}
+
+		a := p.nthEligible(candidates, first, readyOnly)
+		b := p.nthEligible(candidates, second, readyOnly)
+		if candidates[b].(subConnMember).load() < candidates[a].(subConnMember).load() {
+			return b
+		}
+		return a
+	default:
+		if len(p.spreadWeights) > 0 && len(candidates) <= len(p.spreadWeights) {
+			if index, ok := p.weightedIndex(candidates, readyOnly); ok {
+				return index
+			}
+		}
+
+		return p.nthEligible(candidates, p.intn(uint8(eligible)), readyOnly)
+	}
+}
+
+// weightedIndex randomly selects the index of one of the candidates, or if
+// readyOnly, one of the Ready candidates, with odds proportional to their
+// spread weights. It reports false if none of them has any weight.
+func (p *picker) weightedIndex(candidates []hashring.Member, readyOnly bool) (int, bool) {
+	total := 0.0
+	for i, candidate := range candidates {
+		if !readyOnly || p.isReady(candidate.(subConnMember)) {
+			total += p.spreadWeights[i]
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+
+	threshold := p.float64() * total
+	chosen := -1
+	for i, candidate := range candidates {
+		if readyOnly && !p.isReady(candidate.(subConnMember)) {
+			continue
+		}
+
+		if p.spreadWeights[i] > 0 {
+			chosen = i
+		}
+		threshold -= p.spreadWeights[i]
+		if threshold < 0 && chosen == i {
+			break
+		}
+	}
+
+	return chosen, true
+}
+
+// nthEligible returns the index of the nth candidate, or if readyOnly, of the
+// nth Ready candidate.
+func (p *picker) nthEligible(candidates []hashring.Member, n int, readyOnly bool) int {
+	if !readyOnly {
+		return n
+	}
+
+	for i, candidate := range candidates {
+		if p.isReady(candidate.(subConnMember)) {
+			if n == 0 {
+				return i
+			}
+			n--
+		}
+	}
+
+	return 0
+}
+
+// isReady reports whether member's subconn was Ready when the picker was
+// built.
+func (p *picker) isReady(member subConnMember) bool {
+	_, ok := p.ready[member.SubConn]
+	return ok
 }
 
 // intn returns, as an int, a non-negative pseudo-random number in the
@@ -426,10 +2187,19 @@ func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 //
 // Under the hood, it's taking advantage of maphash's use of runtime.fastrand
 // for an extremely fast, thread-safe PRNG.
-var intn = func(n uint8) int {
-	out := int(new(maphash.Hash).Sum64())
-	if out < 0 {
-		out = -out
+//
+// Lemire's multiply-shift method is used rather than a modulo so that every
+// number in the interval is equally likely.
+func intn(n uint8) int {
+	bound := uint64(n)
+	hi, lo := bits.Mul64(new(maphash.Hash).Sum64(), bound)
+	if lo < bound {
+		// Reject the values that would make some results more likely.
+		threshold := -bound % bound
+		for lo < threshold {
+			hi, lo = bits.Mul64(new(maphash.Hash).Sum64(), bound)
+		}
 	}
-	return out % int(n)
+
+	return int(hi)
 }
@@ -4,28 +4,37 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"hash/maphash"
-	"reflect"
+	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
-	"unsafe"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
 
 	"github.com/authzed/consistent/hashring"
 )
 
 type fakeSubConn struct {
 	balancer.SubConn
-	id string
+	id       string
+	connects atomic.Int32
 }
 
-func (fakeSubConn) Connect() {}
+func (sc *fakeSubConn) Connect() { sc.connects.Add(1) }
 
 func keys(members []hashring.Member) []string {
 	keys := make([]string, 0, len(members))
@@ -38,24 +47,6 @@ func keys(members []hashring.Member) []string {
 // Note: this is testing picker behavior and not the hashring
 // behavior itself, see `pkg/consistent` for tests of the hashring.
 func TestConsistentHashringPickerPick(t *testing.T) {
-	// Override the intn function with one that uses a stable seed.
-	intn = func(n uint8) int {
-		h := new(maphash.Hash)
-
-		// This hack sets an unexported field using reflection.
-		var seed maphash.Seed
-		field := reflect.ValueOf(&seed).Elem().Field(0)
-		unsafeField := reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
-		unsafeField.SetUint(uint64(1))
-		h.SetSeed(seed)
-
-		out := int(h.Sum64())
-		if out < 0 {
-			out = -out
-		}
-		return out % int(n)
-	}
-
 	tests := []struct {
 		name   string
 		spread uint8
@@ -94,7 +85,7 @@ func TestConsistentHashringPickerPick(t *testing.T) {
 			},
 			want: balancer.PickResult{
 				// without spread, this would always be 1.
-				// it can be 1 or 3 with spread 2, but pinning the seed makes it always 3 in the test
+				// it can be 1 or 3 with spread 2, but the injected generator makes it always 3 in the test
 				SubConn: &fakeSubConn{id: "3"},
 			},
 		},
@@ -104,6 +95,8 @@ func TestConsistentHashringPickerPick(t *testing.T) {
 			p := &picker{
 				hashring: hashring.MustNew(xxhash.Sum64, tt.rf),
 				spread:   tt.spread,
+				// Always select the last candidate.
+				rand: func(n uint8) int { return int(n) - 1 },
 			}
 			require.NoError(t, p.hashring.Add(subConnMember{key: "1", SubConn: &fakeSubConn{id: "1"}}))
 			require.NoError(t, p.hashring.Add(subConnMember{key: "2", SubConn: &fakeSubConn{id: "2"}}))
@@ -116,11 +109,616 @@ func TestConsistentHashringPickerPick(t *testing.T) {
 	}
 }
 
+func TestIntnUniform(t *testing.T) {
+	for _, n := range []uint8{1, 2, 3, 5, 7, 100, 255} {
+		n := n
+		t.Run(strconv.Itoa(int(n)), func(t *testing.T) {
+			t.Parallel()
+
+			const samplesPerValue = 10_000
+			counts := make([]int, n)
+			for i := 0; i < samplesPerValue*int(n); i++ {
+				v := intn(n)
+				if v < 0 || v >= int(n) {
+					require.Failf(t, "out of range", "intn(%d) returned %d", n, v)
+				}
+				counts[v]++
+			}
+
+			// Each count is binomially distributed with a standard deviation
+			// of at most sqrt(samplesPerValue), so allow 6 of them.
+			tolerance := 6 * math.Sqrt(samplesPerValue)
+			for v, count := range counts {
+				require.InDelta(t, samplesPerValue, count, tolerance, "value %d", v)
+			}
+		})
+	}
+}
+
+func TestConsistentHashringPickerPickKeyValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr bool
+	}{
+		{
+			name:    "nil value",
+			ctx:     context.Background(),
+			wantErr: true,
+		},
+		{
+			name:    "int value",
+			ctx:     context.WithValue(context.Background(), CtxKey, 1),
+			wantErr: true,
+		},
+		{
+			name: "string value",
+			ctx:  context.WithValue(context.Background(), CtxKey, "test"),
+		},
+		{
+			name: "ContextWithKey",
+			ctx:  ContextWithKey(context.Background(), "test"),
+		},
+		{
+			name: "bytes value",
+			ctx:  context.WithValue(context.Background(), CtxKey, []byte("test")),
+		},
+		{
+			name: "WithRequestKey",
+			ctx:  WithRequestKey(context.Background(), []byte("test")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &picker{
+				hashring: hashring.MustNew(xxhash.Sum64, 100),
+				spread:   1,
+			}
+			require.NoError(t, p.hashring.Add(subConnMember{key: "1", SubConn: &fakeSubConn{id: "1"}}))
+
+			got, err := p.Pick(balancer.PickInfo{Ctx: tt.ctx})
+			if tt.wantErr {
+				require.Error(t, err)
+				require.Equal(t, balancer.PickResult{}, got)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, &fakeSubConn{id: "1"}, got.SubConn)
+		})
+	}
+}
+
+// staticPickerBalancer is a balancer that always reports the same picker as
+// Ready, for testing how gRPC handles the errors it returns.
+type staticPickerBalancer struct {
+	balancer.Balancer
+	cc     balancer.ClientConn
+	picker balancer.Picker
+}
+
+func (b *staticPickerBalancer) UpdateClientConnState(balancer.ClientConnState) error {
+	b.cc.UpdateState(balancer.State{ConnectivityState: connectivity.Ready, Picker: b.picker})
+	return nil
+}
+
+func (b *staticPickerBalancer) Close() {}
+
+type staticPickerBuilder struct {
+	name   string
+	picker balancer.Picker
+}
+
+func (b staticPickerBuilder) Build(cc balancer.ClientConn, _ balancer.BuildOptions) balancer.Balancer {
+	return &staticPickerBalancer{cc: cc, picker: b.picker}
+}
+
+func (b staticPickerBuilder) Name() string { return b.name }
+
+func TestConsistentHashringPickerHashringErrorWaitForReady(t *testing.T) {
+	const name = "consistent-hashring-empty-test"
+	balancer.Register(staticPickerBuilder{
+		name:   name,
+		picker: &picker{hashring: hashring.MustNew(xxhash.Sum64, 100), spread: 1},
+	})
+
+	r := manual.NewBuilderWithScheme("empty")
+	r.InitialState(resolver.State{Addresses: []resolver.Address{{Addr: "unused"}}})
+	conn, err := grpc.Dial(
+		r.Scheme()+":///test",
+		grpc.WithResolvers(r),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"`+name+`": {}}]}`),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Without members, fail-fast RPCs fail with Unavailable, which retry
+	// policies can retry.
+	ctx, cancel := context.WithTimeout(ContextWithKey(context.Background(), "key"), 100*time.Millisecond)
+	defer cancel()
+	err = conn.Invoke(ctx, "/test.Service/Method", nil, nil)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// Wait-for-ready RPCs wait for members rather than failing.
+	ctx, cancel = context.WithTimeout(ContextWithKey(context.Background(), "key"), 100*time.Millisecond)
+	defer cancel()
+	err = conn.Invoke(ctx, "/test.Service/Method", nil, nil, grpc.WaitForReady(true))
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestConsistentHashringPickerPickErrorCodes(t *testing.T) {
+	alreadyStatus := status.Error(codes.PermissionDenied, "no shard key for you")
+	tests := []struct {
+		name     string
+		picker   *picker
+		ctx      context.Context
+		code     codes.Code
+		isStatus bool
+		is       error
+	}{
+		{
+			name:     "missing key",
+			picker:   &picker{spread: 1},
+			ctx:      context.Background(),
+			code:     codes.Internal,
+			isStatus: true,
+		},
+		{
+			name:     "bad key",
+			picker:   &picker{spread: 1},
+			ctx:      context.WithValue(context.Background(), CtxKey, 1),
+			code:     codes.Internal,
+			isStatus: true,
+		},
+		{
+			name:     "empty key rejected",
+			picker:   &picker{spread: 1, rejectEmpty: true},
+			ctx:      ContextWithKey(context.Background(), ""),
+			code:     codes.Internal,
+			isStatus: true,
+			is:       ErrEmptyKey,
+		},
+		{
+			name: "key func status kept",
+			picker: &picker{spread: 1, keyFn: func(balancer.PickInfo) ([]byte, error) {
+				return nil, alreadyStatus
+			}},
+			ctx:      context.Background(),
+			code:     codes.PermissionDenied,
+			isStatus: true,
+		},
+		{
+			// gRPC fails the RPC with Unavailable itself, and unlike with a
+			// status error, lets it be retried or wait for a new picker.
+			name:   "empty hashring",
+			picker: &picker{spread: 1},
+			ctx:    ContextWithKey(context.Background(), "key"),
+			code:   codes.Unknown,
+			is:     hashring.ErrNotEnoughMembers,
+		},
+		{
+			name:   "not enough members",
+			picker: &picker{spread: 2},
+			ctx:    ContextWithKey(context.Background(), "key"),
+			code:   codes.Unknown,
+			is:     hashring.ErrNotEnoughMembers,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.picker.hashring = hashring.MustNew(xxhash.Sum64, 100)
+			if tt.picker.spread > 1 {
+				require.NoError(t, tt.picker.hashring.Add(subConnMember{key: "1", SubConn: &fakeSubConn{id: "1"}}))
+			}
+
+			_, err := tt.picker.Pick(balancer.PickInfo{Ctx: tt.ctx})
+			require.Error(t, err)
+
+			_, isStatus := status.FromError(err)
+			require.Equal(t, tt.isStatus, isStatus)
+			require.Equal(t, tt.code, status.Code(err))
+			if tt.is != nil {
+				require.ErrorIs(t, err, tt.is)
+			}
+		})
+	}
+}
+
+func TestConsistentHashringPickerPickStringKey(t *testing.T) {
+	p := &picker{
+		hashring: hashring.MustNew(xxhash.Sum64, 100),
+		spread:   1,
+	}
+	require.NoError(t, p.hashring.Add(subConnMember{key: "1", SubConn: &fakeSubConn{id: "1"}}))
+	require.NoError(t, p.hashring.Add(subConnMember{key: "2", SubConn: &fakeSubConn{id: "2"}}))
+	require.NoError(t, p.hashring.Add(subConnMember{key: "3", SubConn: &fakeSubConn{id: "3"}}))
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		fromBytes, err := p.Pick(balancer.PickInfo{
+			Ctx: context.WithValue(context.Background(), CtxKey, []byte(key)),
+		})
+		require.NoError(t, err)
+
+		fromString, err := p.Pick(balancer.PickInfo{
+			Ctx: ContextWithKey(context.Background(), key),
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, fromBytes, fromString)
+	}
+}
+
+func TestRequestKeyFromContext(t *testing.T) {
+	for _, key := range [][]byte{[]byte("key"), {}, {0, 0xff}} {
+		got, ok := RequestKeyFromContext(WithRequestKey(context.Background(), key))
+		require.True(t, ok)
+		require.Equal(t, key, got)
+
+		got, ok = RequestKeyFromContext(ContextWithKey(context.Background(), string(key)))
+		require.True(t, ok)
+		require.Equal(t, key, got)
+	}
+
+	// The innermost key wins.
+	ctx := WithRequestKey(ContextWithKey(context.Background(), "outer"), []byte("inner"))
+	got, ok := RequestKeyFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, []byte("inner"), got)
+
+	for _, ctx := range []context.Context{
+		context.Background(),
+		context.WithValue(context.Background(), CtxKey, 1),
+		context.WithValue(context.Background(), "requestKey", []byte("key")),
+	} {
+		got, ok := RequestKeyFromContext(ctx)
+		require.False(t, ok)
+		require.Nil(t, got)
+	}
+
+	// Picks made with either helper agree.
+	p := &picker{
+		hashring: hashring.MustNew(xxhash.Sum64, 100),
+		spread:   1,
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}}))
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		fromBytes, err := p.Pick(balancer.PickInfo{Ctx: WithRequestKey(context.Background(), []byte(key))})
+		require.NoError(t, err)
+		fromString, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), key)})
+		require.NoError(t, err)
+		require.Equal(t, fromString, fromBytes)
+	}
+}
+
+func TestConsistentHashringPickerPickSpreadOverride(t *testing.T) {
+	p := &picker{
+		hashring:   hashring.MustNew(xxhash.Sum64, 100),
+		numMembers: 3,
+		spread:     1,
+		// Always select the last candidate.
+		rand: func(n uint8) int { return int(n) - 1 },
+	}
+	require.NoError(t, p.hashring.Add(subConnMember{key: "1", SubConn: &fakeSubConn{id: "1"}}))
+	require.NoError(t, p.hashring.Add(subConnMember{key: "2", SubConn: &fakeSubConn{id: "2"}}))
+	require.NoError(t, p.hashring.Add(subConnMember{key: "3", SubConn: &fakeSubConn{id: "3"}}))
+
+	ordered, err := p.hashring.FindN([]byte("test"), 3)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want hashring.Member
+	}{
+		{
+			name: "absent",
+			ctx:  ContextWithKey(context.Background(), "test"),
+			want: ordered[0],
+		},
+		{
+			name: "present",
+			ctx:  ContextWithSpread(ContextWithKey(context.Background(), "test"), 2),
+			want: ordered[1],
+		},
+		{
+			name: "larger than membership",
+			ctx:  ContextWithSpread(ContextWithKey(context.Background(), "test"), 10),
+			want: ordered[2],
+		},
+		{
+			name: "zero",
+			ctx:  ContextWithSpread(ContextWithKey(context.Background(), "test"), 0),
+			want: ordered[0],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Pick(balancer.PickInfo{Ctx: tt.ctx})
+			require.NoError(t, err)
+			require.Equal(t, tt.want.(subConnMember).SubConn, got.SubConn)
+		})
+	}
+}
+
+func TestConsistentHashringPickerPickReplicas(t *testing.T) {
+	p := &picker{
+		hashring:       hashring.MustNew(xxhash.Sum64, 100),
+		numMembers:     4,
+		spread:         3,
+		fallbackToNext: true,
+		ready:          map[balancer.SubConn]struct{}{},
+	}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		sc := &fakeSubConn{id: id}
+		p.ready[sc] = struct{}{}
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: sc}))
+	}
+
+	ordered, err := p.hashring.FindN([]byte("test"), 3)
+	require.NoError(t, err)
+	orderedKeys := []string{ordered[0].Key(), ordered[1].Key(), ordered[2].Key()}
+
+	// The replicas selected by spread are recorded in hashring order.
+	var replicas Replicas
+	require.Nil(t, replicas.Keys())
+	ctx := ContextWithReplicas(ContextWithKey(context.Background(), "test"), &replicas)
+	_, err = p.Pick(balancer.PickInfo{Ctx: ctx})
+	require.NoError(t, err)
+	require.Equal(t, orderedKeys, replicas.Keys())
+
+	// Each attempt can be pinned to a different replica, whether or not it's
+	// Ready.
+	delete(p.ready, ordered[1].(subConnMember).SubConn)
+	for i := 0; i < 6; i++ {
+		got, err := p.Pick(balancer.PickInfo{Ctx: ContextWithReplica(ctx, uint8(i))})
+		require.NoError(t, err)
+		require.Same(t, ordered[i%3].(subConnMember).SubConn, got.SubConn, "replica %d", i)
+		require.Equal(t, orderedKeys, replicas.Keys())
+	}
+
+	// A spread of 1 has a single replica.
+	ctx = ContextWithSpread(ctx, 1)
+	got, err := p.Pick(balancer.PickInfo{Ctx: ContextWithReplica(ctx, 1)})
+	require.NoError(t, err)
+	require.Same(t, ordered[0].(subConnMember).SubConn, got.SubConn)
+	require.Equal(t, orderedKeys[:1], replicas.Keys())
+}
+
+func TestMetadataKeyFunc(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:    "no key",
+			ctx:     context.Background(),
+			wantErr: true,
+		},
+		{
+			name:    "other header",
+			ctx:     metadata.AppendToOutgoingContext(context.Background(), "x-other", "test"),
+			wantErr: true,
+		},
+		{
+			name: "header",
+			ctx:  metadata.AppendToOutgoingContext(context.Background(), "x-shard-key", "test"),
+			want: []byte("test"),
+		},
+		{
+			name: "context value",
+			ctx:  ContextWithKey(context.Background(), "test"),
+			want: []byte("test"),
+		},
+		{
+			name: "context value wins over header",
+			ctx:  ContextWithKey(metadata.AppendToOutgoingContext(context.Background(), "x-shard-key", "header"), "context"),
+			want: []byte("context"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MetadataKeyFunc("x-shard-key")(balancer.PickInfo{Ctx: tt.ctx})
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCompositeMetadataKeyFunc(t *testing.T) {
+	headers := func(kv ...string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), kv...)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:    "no key",
+			ctx:     context.Background(),
+			wantErr: true,
+		},
+		{
+			name:    "other header",
+			ctx:     headers("x-other", "test"),
+			wantErr: true,
+		},
+		{
+			name: "every header",
+			ctx:  headers("x-tenant", "a", "x-type", "b", "x-id", "c"),
+			want: []byte("a|b|c"),
+		},
+		{
+			name: "headers in any order",
+			ctx:  headers("x-id", "c", "x-type", "b", "x-tenant", "a"),
+			want: []byte("a|b|c"),
+		},
+		{
+			name: "missing middle header",
+			ctx:  headers("x-tenant", "a", "x-id", "c"),
+			want: []byte("a||c"),
+		},
+		{
+			name: "missing last header",
+			ctx:  headers("x-tenant", "a", "x-type", "c"),
+			want: []byte("a|c|"),
+		},
+		{
+			name: "context value wins over headers",
+			ctx:  ContextWithKey(headers("x-tenant", "a", "x-type", "b", "x-id", "c"), "context"),
+			want: []byte("context"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CompositeMetadataKeyFunc("|", "x-tenant", "x-type", "x-id")(balancer.PickInfo{Ctx: tt.ctx})
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConsistentHashringPickerPickKeyFunc(t *testing.T) {
+	b := NewBuilderWithKeyFunc(xxhash.Sum64, MetadataKeyFunc("x-shard-key"))
+	cb := b.Build(newFakeClientConn(), balancer.BuildOptions{}).(*ringBalancer)
+
+	p := &picker{
+		hashring: hashring.MustNew(xxhash.Sum64, 100),
+		spread:   1,
+		keyFn:    cb.keyFn,
+	}
+	require.NoError(t, p.hashring.Add(subConnMember{key: "1", SubConn: &fakeSubConn{id: "1"}}))
+	require.NoError(t, p.hashring.Add(subConnMember{key: "2", SubConn: &fakeSubConn{id: "2"}}))
+	require.NoError(t, p.hashring.Add(subConnMember{key: "3", SubConn: &fakeSubConn{id: "3"}}))
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		fromContext, err := p.Pick(balancer.PickInfo{
+			Ctx: ContextWithKey(context.Background(), key),
+		})
+		require.NoError(t, err)
+
+		fromMetadata, err := p.Pick(balancer.PickInfo{
+			Ctx: metadata.AppendToOutgoingContext(context.Background(), "x-shard-key", key),
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, fromContext, fromMetadata)
+	}
+
+	_, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+	require.Error(t, err)
+}
+
+func TestConsistentHashringPickerPickFallbackToNext(t *testing.T) {
+	subConns := []*fakeSubConn{{id: "1"}, {id: "2"}, {id: "3"}}
+	ring := hashring.MustNew(xxhash.Sum64, 100)
+	for _, sc := range subConns {
+		require.NoError(t, ring.Add(subConnMember{key: sc.id, SubConn: sc}))
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		info := balancer.PickInfo{Ctx: context.WithValue(context.Background(), CtxKey, key)}
+
+		ordered, err := ring.FindN(key, 3)
+		require.NoError(t, err)
+		owner := ordered[0].(subConnMember).SubConn
+		next := ordered[1].(subConnMember).SubConn
+		last := ordered[2].(subConnMember).SubConn
+
+		// Without fallback, the owner is picked even when it isn't ready.
+		got, err := (&picker{hashring: ring, spread: 1}).Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, owner, got.SubConn)
+
+		tests := []struct {
+			name  string
+			ready []balancer.SubConn
+			want  balancer.SubConn
+		}{
+			{"owner ready", []balancer.SubConn{owner, next, last}, owner},
+			{"owner not ready", []balancer.SubConn{next, last}, next},
+			{"only last ready", []balancer.SubConn{last}, last},
+			{"none ready", nil, owner},
+		}
+		for _, tt := range tests {
+			p := &picker{
+				hashring:       ring,
+				spread:         1,
+				fallbackToNext: true,
+				numMembers:     3,
+				ready:          map[balancer.SubConn]struct{}{},
+			}
+			for _, sc := range tt.ready {
+				p.ready[sc] = struct{}{}
+			}
+
+			got, err := p.Pick(info)
+			require.NoError(t, err, tt.name)
+			require.Equal(t, tt.want, got.SubConn, tt.name)
+		}
+
+		// With a spread, the members beyond it are tried before wrapping
+		// around to those before the chosen one.
+		spreadTests := []struct {
+			name  string
+			ready []balancer.SubConn
+			want  balancer.SubConn
+		}{
+			{"chosen ready", []balancer.SubConn{owner, next, last}, next},
+			{"beyond spread ready", []balancer.SubConn{owner, last}, last},
+			{"only before chosen ready", []balancer.SubConn{owner}, owner},
+		}
+		for _, tt := range spreadTests {
+			p := &picker{
+				hashring:       ring,
+				spread:         2,
+				fallbackToNext: true,
+				numMembers:     3,
+				rand:           func(n uint8) int { return int(n) - 1 },
+				ready:          map[balancer.SubConn]struct{}{},
+			}
+			for _, sc := range tt.ready {
+				p.ready[sc] = struct{}{}
+			}
+
+			got, err := p.Pick(info)
+			require.NoError(t, err, tt.name)
+			require.Equal(t, tt.want, got.SubConn, tt.name)
+		}
+	}
+}
+
 func TestConsistentHashringBalancerConfigServiceConfigJSON(t *testing.T) {
 	tests := []struct {
 		name              string
 		replicationFactor uint16
 		spread            uint8
+		grace             time.Duration
 		want              string
 	}{
 		{
@@ -139,12 +737,18 @@ func TestConsistentHashringBalancerConfigServiceConfigJSON(t *testing.T) {
 			spread: 1,
 			want:   `{"loadBalancingConfig":[{"consistent-hashring":{"spread":1}}]}`,
 		},
+		{
+			name:  "sets empty update grace",
+			grace: 1500 * time.Millisecond,
+			want:  `{"loadBalancingConfig":[{"consistent-hashring":{"emptyUpdateGrace":"1.5s"}}]}`,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := &BalancerConfig{
 				ReplicationFactor: tt.replicationFactor,
 				Spread:            tt.spread,
+				EmptyUpdateGrace:  tt.grace,
 			}
 
 			got, err := c.ServiceConfigJSON()
@@ -212,12 +816,12 @@ func TestConsistentHashringBalancerUpdateClientConnState(t *testing.T) {
 			expectedStates: []balancerState{
 				{
 					ConnectivityState: connectivity.Connecting,
-					memberKeys:        []string{"t1", "t2", "t3"},
+					memberKeys:        []string{"t/1", "t/2", "t/3"},
 					replicationFactor: 100,
 					spread:            1,
 				},
 			},
-			expectedConnState: connectivity.Idle,
+			expectedConnState: connectivity.Connecting,
 		},
 		{
 			name: "existing hashring with 3 nodes, 1 removed",
@@ -244,18 +848,18 @@ func TestConsistentHashringBalancerUpdateClientConnState(t *testing.T) {
 			expectedStates: []balancerState{
 				{
 					ConnectivityState: connectivity.Connecting,
-					memberKeys:        []string{"t1", "t2", "t3"},
+					memberKeys:        []string{"t/1", "t/2", "t/3"},
 					replicationFactor: 100,
 					spread:            1,
 				},
 				{
 					ConnectivityState: connectivity.Connecting,
-					memberKeys:        []string{"t1", "t2"},
+					memberKeys:        []string{"t/1", "t/2"},
 					replicationFactor: 100,
 					spread:            1,
 				},
 			},
-			expectedConnState: connectivity.Idle,
+			expectedConnState: connectivity.Connecting,
 		},
 		{
 			name: "existing hashring with 3 nodes, 1 added",
@@ -284,21 +888,21 @@ func TestConsistentHashringBalancerUpdateClientConnState(t *testing.T) {
 			expectedStates: []balancerState{
 				{
 					ConnectivityState: connectivity.Connecting,
-					memberKeys:        []string{"t1", "t2", "t3"},
+					memberKeys:        []string{"t/1", "t/2", "t/3"},
 					replicationFactor: 100,
 					spread:            1,
 				},
 				{
 					ConnectivityState: connectivity.Connecting,
-					memberKeys:        []string{"t1", "t2", "t3", "t4"},
+					memberKeys:        []string{"t/1", "t/2", "t/3", "t/4"},
 					replicationFactor: 100,
 					spread:            1,
 				},
 			},
-			expectedConnState: connectivity.Idle,
+			expectedConnState: connectivity.Connecting,
 		},
 		{
-			name: "existing hashring with 3 nodes, 1 replaced",
+			name: "existing hashring with 3 nodes, replication factor changed",
 			s: []balancer.ClientConnState{{
 				ResolverState: resolver.State{
 					Addresses: []resolver.Address{
@@ -316,53 +920,140 @@ func TestConsistentHashringBalancerUpdateClientConnState(t *testing.T) {
 					Addresses: []resolver.Address{
 						{ServerName: "t", Addr: "1"},
 						{ServerName: "t", Addr: "2"},
-						{ServerName: "t", Addr: "4"},
+						{ServerName: "t", Addr: "3"},
 					},
 				},
+				BalancerConfig: &BalancerConfig{
+					ReplicationFactor: 200,
+					Spread:            1,
+				},
 			}},
 			expectedStates: []balancerState{
 				{
 					ConnectivityState: connectivity.Connecting,
-					memberKeys:        []string{"t1", "t2", "t3"},
+					memberKeys:        []string{"t/1", "t/2", "t/3"},
 					replicationFactor: 100,
 					spread:            1,
 				},
 				{
 					ConnectivityState: connectivity.Connecting,
-					memberKeys:        []string{"t1", "t2", "t4"},
-					replicationFactor: 100,
+					memberKeys:        []string{"t/1", "t/2", "t/3"},
+					replicationFactor: 200,
 					spread:            1,
 				},
 			},
-			expectedConnState: connectivity.Idle,
+			expectedConnState: connectivity.Connecting,
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			b := NewBuilder(xxhash.Sum64)
-			cc := newFakeClientConn()
-			bb := b.Build(cc, balancer.BuildOptions{})
-			cb := bb.(*ringBalancer)
-
-			tt := tt
-
-			done := make(chan struct{})
-
-			go func() {
-				i := 0
-
-				if len(tt.expectedStates) == 0 {
-					done <- struct{}{}
-					return
-				}
-
-				for {
-					s := <-cc.stateCh
-					expected := tt.expectedStates[i]
-					require.Equal(t, expected.ConnectivityState, s.ConnectivityState)
-
-					if expected.err != nil {
-						require.Equal(t, base.NewErrPicker(expected.err), s.Picker)
+		{
+			name: "existing hashring with 3 nodes, hash function changed",
+			s: []balancer.ClientConnState{{
+				ResolverState: resolver.State{
+					Addresses: []resolver.Address{
+						{ServerName: "t", Addr: "1"},
+						{ServerName: "t", Addr: "2"},
+						{ServerName: "t", Addr: "3"},
+					},
+				},
+				BalancerConfig: &BalancerConfig{
+					ReplicationFactor: 100,
+					Spread:            1,
+				},
+			}, {
+				ResolverState: resolver.State{
+					Addresses: []resolver.Address{
+						{ServerName: "t", Addr: "1"},
+						{ServerName: "t", Addr: "2"},
+						{ServerName: "t", Addr: "3"},
+					},
+				},
+				BalancerConfig: &BalancerConfig{
+					ReplicationFactor: 100,
+					Spread:            1,
+					HashFunc:          "sha256",
+				},
+			}},
+			expectedStates: []balancerState{
+				{
+					ConnectivityState: connectivity.Connecting,
+					memberKeys:        []string{"t/1", "t/2", "t/3"},
+					replicationFactor: 100,
+					spread:            1,
+				},
+				{
+					ConnectivityState: connectivity.Connecting,
+					memberKeys:        []string{"t/1", "t/2", "t/3"},
+					replicationFactor: 100,
+					spread:            1,
+				},
+			},
+			expectedConnState: connectivity.Connecting,
+		},
+		{
+			name: "existing hashring with 3 nodes, 1 replaced",
+			s: []balancer.ClientConnState{{
+				ResolverState: resolver.State{
+					Addresses: []resolver.Address{
+						{ServerName: "t", Addr: "1"},
+						{ServerName: "t", Addr: "2"},
+						{ServerName: "t", Addr: "3"},
+					},
+				},
+				BalancerConfig: &BalancerConfig{
+					ReplicationFactor: 100,
+					Spread:            1,
+				},
+			}, {
+				ResolverState: resolver.State{
+					Addresses: []resolver.Address{
+						{ServerName: "t", Addr: "1"},
+						{ServerName: "t", Addr: "2"},
+						{ServerName: "t", Addr: "4"},
+					},
+				},
+			}},
+			expectedStates: []balancerState{
+				{
+					ConnectivityState: connectivity.Connecting,
+					memberKeys:        []string{"t/1", "t/2", "t/3"},
+					replicationFactor: 100,
+					spread:            1,
+				},
+				{
+					ConnectivityState: connectivity.Connecting,
+					memberKeys:        []string{"t/1", "t/2", "t/4"},
+					replicationFactor: 100,
+					spread:            1,
+				},
+			},
+			expectedConnState: connectivity.Connecting,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBuilder(xxhash.Sum64)
+			cc := newFakeClientConn()
+			bb := b.Build(cc, balancer.BuildOptions{})
+			cb := bb.(*ringBalancer)
+
+			tt := tt
+
+			done := make(chan struct{})
+
+			go func() {
+				i := 0
+
+				if len(tt.expectedStates) == 0 {
+					done <- struct{}{}
+					return
+				}
+
+				for {
+					s := <-cc.stateCh
+					expected := tt.expectedStates[i]
+					require.Equal(t, expected.ConnectivityState, s.ConnectivityState)
+
+					if expected.err != nil {
+						require.Equal(t, base.NewErrPicker(expected.err), s.Picker)
 					} else {
 						p := s.Picker.(*picker)
 						require.Equal(t, expected.spread, p.spread)
@@ -392,23 +1083,29 @@ type fakeClientConn struct {
 
 	stateCh chan balancer.State
 
-	mu       sync.Mutex
-	subConns map[balancer.SubConn]resolver.Address
+	mu           sync.Mutex
+	subConns     map[balancer.SubConn]resolver.Address
+	subConnAddrs map[balancer.SubConn][]resolver.Address
+	subConnOpt   map[balancer.SubConn]balancer.NewSubConnOptions
 }
 
 func newFakeClientConn() *fakeClientConn {
 	return &fakeClientConn{
-		subConns: make(map[balancer.SubConn]resolver.Address),
-		stateCh:  make(chan balancer.State),
+		subConns:     make(map[balancer.SubConn]resolver.Address),
+		subConnAddrs: make(map[balancer.SubConn][]resolver.Address),
+		subConnOpt:   make(map[balancer.SubConn]balancer.NewSubConnOptions),
+		stateCh:      make(chan balancer.State),
 	}
 }
 
-func (c *fakeClientConn) NewSubConn(addrs []resolver.Address, _ balancer.NewSubConnOptions) (balancer.SubConn, error) {
-	sc := &fakeSubConn{}
+func (c *fakeClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc := &fakeSubConn{id: DefaultMemberKey(addrs[0])}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.subConns[sc] = addrs[0]
+	c.subConnAddrs[sc] = addrs
+	c.subConnOpt[sc] = opts
 
 	return sc, nil
 }
@@ -417,8 +1114,1684 @@ func (c *fakeClientConn) RemoveSubConn(sc balancer.SubConn) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	delete(c.subConns, sc)
+	delete(c.subConnAddrs, sc)
 }
 
 func (c *fakeClientConn) UpdateState(s balancer.State) {
 	c.stateCh <- s
 }
+
+// subConn returns the SubConn created for the address with the given key.
+func (c *fakeClientConn) subConn(key string) balancer.SubConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for sc, addr := range c.subConns {
+		if DefaultMemberKey(addr) == key {
+			return sc
+		}
+	}
+
+	return nil
+}
+
+func TestConsistentHashringBalancerHealthCheck(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := NewBuilder(xxhash.Sum64).Build(cc, balancer.BuildOptions{})
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+				{ServerName: "t", Addr: "3"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{
+			ReplicationFactor: 100,
+			Spread:            3,
+			EnableHealthCheck: true,
+		},
+	}))
+	<-states
+
+	for _, key := range []string{"t/1", "t/2", "t/3"} {
+		require.True(t, cc.subConnOpt[cc.subConn(key)].HealthCheckEnabled)
+	}
+
+	// pickAll asserts that every key is routed to the expected subconn.
+	pickAll := func(p balancer.Picker, expected balancer.SubConn) {
+		for i := 0; i < 100; i++ {
+			got, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), strconv.Itoa(i))})
+			require.NoError(t, err)
+			require.Same(t, expected, got.SubConn)
+		}
+	}
+
+	bb.UpdateSubConnState(cc.subConn("t/2"), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	s := <-states
+	require.Equal(t, connectivity.Ready, s.ConnectivityState)
+	pickAll(s.Picker, cc.subConn("t/2"))
+
+	// t2 fails its health check while t3 becomes healthy.
+	bb.UpdateSubConnState(cc.subConn("t/3"), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	<-states
+	bb.UpdateSubConnState(cc.subConn("t/2"), balancer.SubConnState{ConnectivityState: connectivity.TransientFailure})
+	s = <-states
+	pickAll(s.Picker, cc.subConn("t/3"))
+}
+
+func TestConsistentHashringBalancerHealthCheckEnabled(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	b := NewBuilder(xxhash.Sum64)
+	bb := b.Build(cc, balancer.BuildOptions{})
+	resolverState := resolver.State{
+		Addresses: []resolver.Address{
+			{ServerName: "t", Addr: "1"},
+			{ServerName: "t", Addr: "2"},
+		},
+	}
+
+	// Health checking is off by default.
+	cfg, err := b.ParseConfig([]byte(`{}`))
+	require.NoError(t, err)
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{ResolverState: resolverState, BalancerConfig: cfg}))
+	<-states
+
+	before := map[string]balancer.SubConn{}
+	for _, key := range []string{"t/1", "t/2"} {
+		before[key] = cc.subConn(key)
+		require.False(t, cc.subConnOpt[before[key]].HealthCheckEnabled)
+	}
+
+	// Turning it on replaces every subconn with one that has it enabled.
+	cfg, err = b.ParseConfig([]byte(`{"enableHealthCheck": true}`))
+	require.NoError(t, err)
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{ResolverState: resolverState, BalancerConfig: cfg}))
+	<-states
+
+	cc.mu.Lock()
+	require.Len(t, cc.subConns, 2)
+	cc.mu.Unlock()
+	for _, key := range []string{"t/1", "t/2"} {
+		sc := cc.subConn(key)
+		require.NotSame(t, before[key], sc)
+		require.True(t, cc.subConnOpt[sc].HealthCheckEnabled)
+		require.Same(t, sc, bb.(*ringBalancer).subConns[key].SubConn)
+	}
+
+	// An unchanged setting keeps the subconns.
+	after := cc.subConn("t/1")
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{ResolverState: resolverState, BalancerConfig: cfg}))
+	<-states
+	require.Same(t, after, cc.subConn("t/1"))
+}
+
+func TestConsistentHashringBalancerHealthCheckEnabledOnly(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	b := NewBuilder(xxhash.Sum64)
+	bb := b.Build(cc, balancer.BuildOptions{})
+
+	cfg, err := b.ParseConfig([]byte(`{"healthCheckEnabled": true}`))
+	require.NoError(t, err)
+	require.True(t, cfg.(*BalancerConfig).HealthCheckEnabled)
+	require.False(t, cfg.(*BalancerConfig).EnableHealthCheck)
+
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: cfg,
+	}))
+	s := <-states
+
+	// Subconns are health checked, but the picker doesn't prefer Ready ones.
+	for _, key := range []string{"t/1", "t/2"} {
+		require.True(t, cc.subConnOpt[cc.subConn(key)].HealthCheckEnabled)
+	}
+	require.False(t, s.Picker.(*picker).preferReady)
+}
+
+func TestConsistentHashringBalancerPickCounts(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	b := NewBuilder(xxhash.Sum64)
+	bb := b.Build(cc, balancer.BuildOptions{})
+	require.Empty(t, b.(BalancerTracker).LastBalancer().PickCounts())
+
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+				{ServerName: "t", Addr: "3"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{
+			ReplicationFactor: 100,
+			Spread:            1,
+		},
+	}))
+	p := (<-states).Picker.(*picker)
+
+	require.Equal(t, map[string]uint64{"t/1": 0, "t/2": 0, "t/3": 0}, b.(BalancerTracker).LastBalancer().PickCounts())
+
+	const numPicks = 1000
+	expected := map[string]uint64{"t/1": 0, "t/2": 0, "t/3": 0}
+	for i := 0; i < numPicks; i++ {
+		key := []byte(strconv.Itoa(i))
+
+		owner, err := p.hashring.Find(key)
+		require.NoError(t, err)
+		expected[owner.Key()]++
+
+		_, err = p.Pick(balancer.PickInfo{Ctx: context.WithValue(context.Background(), CtxKey, key)})
+		require.NoError(t, err)
+	}
+
+	counts := b.(BalancerTracker).LastBalancer().PickCounts()
+	require.Equal(t, expected, counts)
+
+	total := uint64(0)
+	for _, count := range counts {
+		total += count
+	}
+	require.Equal(t, uint64(numPicks), total)
+
+	b.(BalancerTracker).LastBalancer().ResetPickCounts()
+	require.Equal(t, map[string]uint64{"t/1": 0, "t/2": 0, "t/3": 0}, b.(BalancerTracker).LastBalancer().PickCounts())
+}
+
+func TestConsistentHashringBalancerStats(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	b := NewBuilder(xxhash.Sum64)
+	bb := b.Build(cc, balancer.BuildOptions{})
+	require.Equal(t, BalancerStats{
+		State:            connectivity.Connecting,
+		PicksPerBackend:  map[string]uint64{},
+		ErrorsPerBackend: map[string]uint64{},
+	}, b.(BalancerTracker).LastBalancer().Stats())
+
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+				{ServerName: "t", Addr: "3"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{ReplicationFactor: 100, Spread: 1},
+	}))
+	<-states
+	for _, key := range []string{"t/1", "t/2", "t/3"} {
+		bb.UpdateSubConnState(cc.subConn(key), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+		<-states
+	}
+	p := bb.(*ringBalancer).picker
+
+	const numPicks = 300
+	picks := map[string]uint64{"t/1": 0, "t/2": 0, "t/3": 0}
+	errs := map[string]uint64{"t/1": 0, "t/2": 0, "t/3": 0}
+	for i := 0; i < numPicks; i++ {
+		result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), strconv.Itoa(i))})
+		require.NoError(t, err)
+
+		backend := result.SubConn.(*fakeSubConn).id
+		picks[backend]++
+
+		var rpcErr error
+		if i%3 == 0 {
+			rpcErr = errors.New("unavailable")
+			errs[backend]++
+		}
+		result.Done(balancer.DoneInfo{Err: rpcErr})
+	}
+
+	// Requests without a key can't be picked.
+	for i := 0; i < 5; i++ {
+		_, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		require.Error(t, err)
+	}
+
+	require.Equal(t, BalancerStats{
+		Members:          3,
+		State:            connectivity.Ready,
+		Picks:            numPicks,
+		PickErrors:       5,
+		PicksPerBackend:  picks,
+		ErrorsPerBackend: errs,
+	}, b.(BalancerTracker).LastBalancer().Stats())
+
+	// Resetting the per-backend counts leaves the totals alone.
+	b.(BalancerTracker).LastBalancer().ResetPickCounts()
+	stats := b.(BalancerTracker).LastBalancer().Stats()
+	require.Equal(t, uint64(numPicks), stats.Picks)
+	require.Equal(t, uint64(5), stats.PickErrors)
+	require.Equal(t, map[string]uint64{"t/1": 0, "t/2": 0, "t/3": 0}, stats.PicksPerBackend)
+
+	// The state follows the balancer.
+	for _, key := range []string{"t/1", "t/2", "t/3"} {
+		bb.UpdateSubConnState(cc.subConn(key), balancer.SubConnState{ConnectivityState: connectivity.TransientFailure})
+		<-states
+	}
+	require.Equal(t, connectivity.TransientFailure, b.(BalancerTracker).LastBalancer().Stats().State)
+}
+
+func TestConsistentHashringPickerPickDone(t *testing.T) {
+	stats := map[string]*subConnStats{}
+	p := &picker{
+		hashring: hashring.MustNew(xxhash.Sum64, 100),
+		spread:   1,
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		stats[id] = newSubConnStats(nil)
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}, stats: stats[id]}))
+	}
+
+	info := balancer.PickInfo{Ctx: context.WithValue(context.Background(), CtxKey, []byte("test"))}
+	owner, err := p.hashring.Find([]byte("test"))
+	require.NoError(t, err)
+	ownerStats := stats[owner.Key()]
+
+	first, err := p.Pick(info)
+	require.NoError(t, err)
+	require.NotNil(t, first.Done)
+
+	second, err := p.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), ownerStats.inFlight.Load())
+	require.Equal(t, uint64(2), ownerStats.picks.Load())
+
+	first.Done(balancer.DoneInfo{})
+	require.Equal(t, int64(1), ownerStats.inFlight.Load())
+	require.Equal(t, uint64(0), ownerStats.errors.Load())
+
+	second.Done(balancer.DoneInfo{Err: errors.New("failed")})
+	require.Equal(t, int64(0), ownerStats.inFlight.Load())
+	require.Equal(t, uint64(1), ownerStats.errors.Load())
+
+	// Picking and completing a request shouldn't allocate.
+	allocs := testing.AllocsPerRun(100, func() {
+		result, _ := p.Pick(info)
+		result.Done(balancer.DoneInfo{})
+	})
+	require.Zero(t, allocs)
+	require.Equal(t, int64(0), ownerStats.inFlight.Load())
+}
+
+func TestConsistentHashringBalancerRingSnapshot(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+	require.Nil(t, b.(BalancerTracker).LastBalancer())
+
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	require.Equal(t, bb, b.(BalancerTracker).LastBalancer())
+	require.Empty(t, b.(BalancerTracker).LastBalancer().RingSnapshot())
+
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{
+			ReplicationFactor: 20,
+			Spread:            1,
+		},
+	}))
+
+	require.ElementsMatch(t, []RingMember{
+		{Key: "t/1", VirtualNodes: 20},
+		{Key: "t/2", VirtualNodes: 20},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+}
+
+func TestConsistentHashringBalancerLastRebalance(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	at, added, removed := b.(BalancerTracker).LastBalancer().LastRebalance()
+	require.True(t, at.IsZero())
+	require.Empty(t, added)
+	require.Empty(t, removed)
+
+	config := &BalancerConfig{ReplicationFactor: 20, Spread: 1}
+	update := func(addrs ...string) {
+		state := resolver.State{}
+		for _, addr := range addrs {
+			state.Addresses = append(state.Addresses, resolver.Address{ServerName: "t", Addr: addr})
+		}
+		require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{ResolverState: state, BalancerConfig: config}))
+	}
+
+	before := time.Now()
+	update("2", "1", "3")
+	at, added, removed = b.(BalancerTracker).LastBalancer().LastRebalance()
+	require.False(t, at.Before(before))
+	require.False(t, at.After(time.Now()))
+	require.Equal(t, []string{"t/1", "t/2", "t/3"}, added)
+	require.Empty(t, removed)
+
+	update("1", "4", "5")
+	last, added, removed := b.(BalancerTracker).LastBalancer().LastRebalance()
+	require.False(t, last.Before(at))
+	require.Equal(t, []string{"t/4", "t/5"}, added)
+	require.Equal(t, []string{"t/2", "t/3"}, removed)
+
+	// Updates that don't change the membership aren't rebalances.
+	update("5", "4", "1")
+	at, added, removed = b.(BalancerTracker).LastBalancer().LastRebalance()
+	require.Equal(t, last, at)
+	require.Equal(t, []string{"t/4", "t/5"}, added)
+	require.Equal(t, []string{"t/2", "t/3"}, removed)
+}
+
+func TestConsistentHashringBalancerExitIdle(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := NewBuilder(xxhash.Sum64).Build(cc, balancer.BuildOptions{})
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{
+			ReplicationFactor: 100,
+			Spread:            1,
+		},
+	}))
+	<-states
+
+	t1 := cc.subConn("t/1").(*fakeSubConn)
+	t2 := cc.subConn("t/2").(*fakeSubConn)
+	bb.UpdateSubConnState(t1, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	require.Equal(t, connectivity.Ready, (<-states).ConnectivityState)
+
+	// New subconns are connecting, so t2 has to go idle for ExitIdle to have
+	// anything to do.
+	bb.UpdateSubConnState(t2, balancer.SubConnState{ConnectivityState: connectivity.Idle})
+	<-states
+
+	readyConnects, connects := t1.connects.Load(), t2.connects.Load()
+	bb.(balancer.ExitIdler).ExitIdle()
+	s := <-states
+	require.Equal(t, connectivity.Ready, s.ConnectivityState)
+	require.Equal(t, connects+1, t2.connects.Load(), "idle subconn should be told to connect")
+	require.Equal(t, readyConnects, t1.connects.Load(), "ready subconn shouldn't be told to connect")
+
+	// Subconns that are already connecting aren't asked again.
+	bb.(balancer.ExitIdler).ExitIdle()
+	require.Equal(t, connects+1, t2.connects.Load())
+}
+
+func TestConsistentHashringBalancerEmptyUpdateGrace(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := NewBuilder(xxhash.Sum64).Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{
+		ReplicationFactor: 100,
+		Spread:            1,
+		EmptyUpdateGrace:  time.Hour,
+	}
+	populated := balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+			},
+		},
+		BalancerConfig: config,
+	}
+	require.NoError(t, bb.UpdateClientConnState(populated))
+	<-states
+
+	t1 := cc.subConn("t/1")
+	bb.UpdateSubConnState(t1, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	require.Equal(t, connectivity.Ready, (<-states).ConnectivityState)
+
+	pick := func(p balancer.Picker) {
+		result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key")})
+		require.NoError(t, err)
+		require.Same(t, t1, result.SubConn)
+	}
+
+	// Zero addresses within the grace period keep the last known hashring
+	// serving, though the resolver is asked to try again.
+	for i := 0; i < 2; i++ {
+		err := bb.UpdateClientConnState(balancer.ClientConnState{BalancerConfig: config})
+		require.ErrorIs(t, err, balancer.ErrBadResolverState)
+		s := <-states
+		require.Equal(t, connectivity.Ready, s.ConnectivityState)
+		pick(s.Picker)
+		require.Same(t, t1, cc.subConn("t/1"))
+	}
+
+	// The resolver recovers before the grace period passes.
+	require.NoError(t, bb.UpdateClientConnState(populated))
+	s := <-states
+	require.Equal(t, connectivity.Ready, s.ConnectivityState)
+	pick(s.Picker)
+	require.Same(t, t1, cc.subConn("t/1"))
+	require.Nil(t, bb.(*ringBalancer).graceTimer)
+
+	// Once the grace period passes without addresses, the balancer fails.
+	config = &BalancerConfig{
+		ReplicationFactor: 100,
+		Spread:            1,
+		EmptyUpdateGrace:  10 * time.Millisecond,
+	}
+	require.ErrorIs(t, bb.UpdateClientConnState(balancer.ClientConnState{BalancerConfig: config}), balancer.ErrBadResolverState)
+	pick((<-states).Picker)
+
+	s = <-states
+	require.Equal(t, connectivity.TransientFailure, s.ConnectivityState)
+	_, err := s.Picker.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key")})
+	require.ErrorContains(t, err, "produced zero addresses")
+	require.Nil(t, cc.subConn("t/1"))
+}
+
+func TestConsistentHashringBalancerWeightAttribute(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	update := func(addrs ...resolver.Address) {
+		require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+			ResolverState: resolver.State{Addresses: addrs},
+			BalancerConfig: &BalancerConfig{
+				ReplicationFactor: 10,
+				Spread:            1,
+			},
+		}))
+	}
+
+	update(
+		resolver.Address{ServerName: "t", Addr: "1"},
+		AddressWithWeight(resolver.Address{ServerName: "t", Addr: "2"}, 2),
+		AddressWithWeight(resolver.Address{ServerName: "t", Addr: "3"}, 5),
+	)
+	require.ElementsMatch(t, []RingMember{
+		{Key: "t/1", VirtualNodes: 10},
+		{Key: "t/2", VirtualNodes: 20},
+		{Key: "t/3", VirtualNodes: 50},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+
+	// Weights follow resolver updates without replacing the subconns.
+	t3 := cc.subConn("t/3")
+	update(
+		AddressWithWeight(resolver.Address{ServerName: "t", Addr: "1"}, 3),
+		resolver.Address{ServerName: "t", Addr: "2"},
+		AddressWithWeight(resolver.Address{ServerName: "t", Addr: "3"}, 5),
+	)
+	require.ElementsMatch(t, []RingMember{
+		{Key: "t/1", VirtualNodes: 30},
+		{Key: "t/2", VirtualNodes: 10},
+		{Key: "t/3", VirtualNodes: 50},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+	require.Same(t, t3, cc.subConn("t/3"))
+}
+
+func TestConsistentHashringBalancerDuplicateKey(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 10, Spread: 1}
+
+	// Both addresses map to the hashring key "t/1".
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "1", Attributes: attributes.New("zone", "a")},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.ElementsMatch(t, []RingMember{
+		{Key: "t/1", VirtualNodes: 10},
+		{Key: "t/2", VirtualNodes: 10},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+
+	cc.mu.Lock()
+	require.Len(t, cc.subConns, 2, "the duplicate shouldn't get a subconn")
+	cc.mu.Unlock()
+
+	// Removing the ignored duplicate leaves the original member in place.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.ElementsMatch(t, []RingMember{
+		{Key: "t/1", VirtualNodes: 10},
+		{Key: "t/2", VirtualNodes: 10},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+}
+
+func TestConsistentHashringBalancerDuplicateAddresses(t *testing.T) {
+	logger := &recordingLogger{}
+	b := NewBuilder(xxhash.Sum64, WithLogger(logger))
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 10, Spread: 1}
+
+	// The resolver lists the same address twice.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "1"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.Equal(t, []RingMember{{Key: "t/1", VirtualNodes: 10}}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+	cc.mu.Lock()
+	require.Len(t, cc.subConns, 1)
+	cc.mu.Unlock()
+	require.Len(t, logger.warnings, 1)
+	require.Contains(t, logger.warnings[0], `hashring member "t/1" already exists`)
+
+	// An endpoint lists the same address twice, which is dropped so that its
+	// key is the same as if it were listed once.
+	logger.warnings = nil
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Endpoints: []resolver.Endpoint{{
+				Addresses: []resolver.Address{
+					{ServerName: "t", Addr: "1"},
+					{ServerName: "t", Addr: "2"},
+					{ServerName: "t", Addr: "1"},
+				},
+			}},
+		},
+		BalancerConfig: config,
+	}))
+	require.Equal(t, []RingMember{{Key: "t/1,t/2", VirtualNodes: 10}}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+	sc := cc.subConn("t/1")
+	require.NotNil(t, sc)
+	cc.mu.Lock()
+	require.Equal(t, []resolver.Address{{ServerName: "t", Addr: "1"}, {ServerName: "t", Addr: "2"}}, cc.subConnAddrs[sc])
+	cc.mu.Unlock()
+	require.Len(t, logger.warnings, 1)
+	require.Contains(t, logger.warnings[0], `ignoring duplicate addresses ["t/1"]`)
+
+	// Listing the endpoint properly keeps its subconn.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Endpoints: []resolver.Endpoint{{
+				Addresses: []resolver.Address{
+					{ServerName: "t", Addr: "2"},
+					{ServerName: "t", Addr: "1"},
+				},
+			}},
+		},
+		BalancerConfig: config,
+	}))
+	require.Same(t, sc, cc.subConn("t/1"))
+}
+
+func TestUniqueAddresses(t *testing.T) {
+	addrs := []resolver.Address{{Addr: "1"}, {Addr: "2"}}
+	unique, duplicates := uniqueAddresses(addrs, DefaultMemberKey)
+	require.Equal(t, addrs, unique)
+	require.Empty(t, duplicates)
+
+	withDuplicates := []resolver.Address{{Addr: "1"}, {Addr: "2"}, {Addr: "1"}, {Addr: "2"}, {Addr: "3"}}
+	unique, duplicates = uniqueAddresses(withDuplicates, DefaultMemberKey)
+	require.Equal(t, []resolver.Address{{Addr: "1"}, {Addr: "2"}, {Addr: "3"}}, unique)
+	require.Equal(t, []string{"1", "2"}, duplicates)
+	require.Equal(t, resolver.Address{Addr: "2"}, withDuplicates[1], "the input is left unchanged")
+}
+
+func TestConsistentHashringBalancerEmptyMemberKey(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+
+	// A blank address is ignored rather than joining the hashring or failing
+	// the whole update.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{},
+			},
+		},
+		BalancerConfig: &BalancerConfig{ReplicationFactor: 10, Spread: 1},
+	}))
+	require.Equal(t, []RingMember{{Key: "t/1", VirtualNodes: 10}}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+
+	cc.mu.Lock()
+	require.Len(t, cc.subConns, 1, "the blank address shouldn't get a subconn")
+	cc.mu.Unlock()
+}
+
+func TestConsistentHashringBalancerRemoveUnknownMember(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 10, Spread: 1}
+
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+
+	// The member for t2 disappears from the hashring behind the balancer's back.
+	require.NoError(t, bb.(*ringBalancer).hashring.RemoveByKey("t/2"))
+
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.Equal(t, []RingMember{{Key: "t/1", VirtualNodes: 10}}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+	require.Nil(t, cc.subConn("t/2"), "the subconn should still be removed")
+}
+
+func TestConsistentHashringBalancerAddFailure(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 100, Spread: 1}
+
+	// t/2 is skipped, since its weight gives it too many vnodes, but the rest
+	// of the update is applied.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				AddressWithWeight(resolver.Address{ServerName: "t", Addr: "2"}, math.MaxUint16),
+			},
+		},
+		BalancerConfig: config,
+	}))
+
+	rb := bb.(*ringBalancer)
+	require.NotNil(t, cc.subConn("t/1"))
+	require.Nil(t, cc.subConn("t/2"), "no subconn should be created for the skipped address")
+	require.Len(t, rb.subConns, 1)
+	require.Len(t, rb.scStates, 1)
+	require.Equal(t, 1, rb.hashring.Size())
+
+	// The update that skips t/2 still removes members the resolver dropped.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				AddressWithWeight(resolver.Address{ServerName: "t", Addr: "2"}, math.MaxUint16),
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.Nil(t, cc.subConn("t/1"), "the subconn of the removed address should be removed")
+	require.Zero(t, rb.hashring.Size())
+
+	// The address is retried on the next update.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.NotNil(t, cc.subConn("t/2"))
+	require.Len(t, rb.subConns, 2)
+	require.Equal(t, 2, rb.hashring.Size())
+
+	// A replication factor that leaves a member with too many vnodes for its
+	// weight can't be applied.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				AddressWithWeight(resolver.Address{ServerName: "t", Addr: "1"}, 600),
+			},
+		},
+		BalancerConfig: config,
+	}))
+	err := bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				AddressWithWeight(resolver.Address{ServerName: "t", Addr: "1"}, 600),
+			},
+		},
+		BalancerConfig: &BalancerConfig{ReplicationFactor: 200, Spread: 1},
+	})
+	require.ErrorIs(t, err, hashring.ErrInvalidWeight)
+	var mutationErr *HashringMutationError
+	require.ErrorAs(t, err, &mutationErr)
+	require.Equal(t, "resize", mutationErr.Op)
+}
+
+func TestConsistentHashringBalancerPickerErrors(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := NewBuilder(xxhash.Sum64).Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 100, Spread: 1, EmptyUpdateGrace: time.Hour}
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	<-states
+
+	// The resolver stops producing addresses while the balancer serves from
+	// the last known ones, which all fail.
+	require.ErrorIs(t, bb.UpdateClientConnState(balancer.ClientConnState{BalancerConfig: config}), balancer.ErrBadResolverState)
+	<-states
+	connErrs := map[string]error{}
+	var s balancer.State
+	for _, key := range []string{"t/1", "t/2"} {
+		connErrs[key] = fmt.Errorf("dial %s: connection refused", key)
+		bb.UpdateSubConnState(cc.subConn(key), balancer.SubConnState{
+			ConnectivityState: connectivity.TransientFailure,
+			ConnectionError:   connErrs[key],
+		})
+		s = <-states
+	}
+	require.Equal(t, connectivity.TransientFailure, s.ConnectivityState)
+
+	// Every error joined into the picker's error can be matched.
+	_, err := s.Picker.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key")})
+	require.ErrorIs(t, err, ErrZeroAddresses)
+	for _, connErr := range connErrs {
+		require.ErrorIs(t, err, connErr)
+	}
+	require.NotErrorIs(t, err, ErrHashringMutation)
+}
+
+func TestConsistentHashringPickerPickBoundedLoad(t *testing.T) {
+	var total atomic.Int64
+	stats := map[string]*subConnStats{}
+	p := &picker{
+		hashring:      hashring.MustNew(xxhash.Sum64, 100),
+		numMembers:    3,
+		spread:        1,
+		maxLoadFactor: 1.25,
+		totalInFlight: &total,
+		cache:         newPickCache(1),
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		stats[id] = newSubConnStats(&total)
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}, stats: stats[id]}))
+	}
+
+	key := []byte("hot")
+	order, err := p.hashring.FindN(key, 3)
+	require.NoError(t, err)
+	owner, next := stats[order[0].Key()], stats[order[1].Key()]
+
+	// Every request uses the same key, but the owner only takes its share.
+	info := balancer.PickInfo{Ctx: context.WithValue(context.Background(), CtxKey, key)}
+	const numPicks = 30
+	results := make([]balancer.PickResult, 0, numPicks)
+	for i := 0; i < numPicks; i++ {
+		result, err := p.Pick(info)
+		require.NoError(t, err)
+		results = append(results, result)
+
+		limit := int64(math.Ceil(1.25 * float64(total.Load()) / 3))
+		require.LessOrEqual(t, owner.inFlight.Load(), limit)
+	}
+	require.Equal(t, int64(numPicks), total.Load())
+	require.Positive(t, next.inFlight.Load(), "overflow should spill to the next member")
+	require.GreaterOrEqual(t, owner.inFlight.Load(), next.inFlight.Load())
+
+	// Only the owner is found up front; the rest are found when it's over
+	// its bound.
+	cached, ok := p.cache.get(key, 1)
+	require.True(t, ok)
+	require.Equal(t, order[:1], cached)
+
+	// Once requests complete, the owner takes the key again.
+	for _, result := range results {
+		result.Done(balancer.DoneInfo{})
+	}
+	require.Zero(t, total.Load())
+
+	result, err := p.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, order[0].(subConnMember).SubConn, result.SubConn)
+	result.Done(balancer.DoneInfo{})
+}
+
+func TestConsistentHashringPickerPickSpreadStrategy(t *testing.T) {
+	for _, strategy := range []SpreadStrategy{SpreadRandom, SpreadLeastLoaded, SpreadPowerOfTwo} {
+		strategy := strategy
+		t.Run(string(strategy), func(t *testing.T) {
+			var total atomic.Int64
+			stats := map[string]*subConnStats{}
+			p := &picker{
+				hashring:       hashring.MustNew(xxhash.Sum64, 100),
+				numMembers:     3,
+				spread:         3,
+				spreadStrategy: strategy,
+			}
+			for _, id := range []string{"1", "2", "3"} {
+				stats[id] = newSubConnStats(&total)
+				require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}, stats: stats[id]}))
+			}
+
+			// Backend 1 is saturated by requests that are still in flight.
+			stats["1"].inFlight.Add(100)
+
+			const numPicks = 60
+			picks := map[string]int{}
+			for i := 0; i < numPicks; i++ {
+				result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), strconv.Itoa(i))})
+				require.NoError(t, err)
+				picks[result.SubConn.(*fakeSubConn).id]++
+			}
+
+			switch strategy {
+			case SpreadRandom:
+				require.Positive(t, picks["1"], "random selection ignores load")
+			case SpreadLeastLoaded:
+				// The burst is split evenly between the other backends.
+				require.Zero(t, picks["1"])
+				require.Equal(t, numPicks/2, picks["2"])
+				require.Equal(t, numPicks/2, picks["3"])
+			case SpreadPowerOfTwo:
+				// The saturated backend always loses the comparison.
+				require.Zero(t, picks["1"])
+				require.Equal(t, numPicks, picks["2"]+picks["3"])
+			}
+		})
+	}
+}
+
+func TestConsistentHashringPickerPickSpreadStrategyPreferReady(t *testing.T) {
+	for _, strategy := range []SpreadStrategy{SpreadLeastLoaded, SpreadPowerOfTwo} {
+		var total atomic.Int64
+		ready := &fakeSubConn{id: "2"}
+		p := &picker{
+			hashring:       hashring.MustNew(xxhash.Sum64, 100),
+			numMembers:     3,
+			spread:         3,
+			spreadStrategy: strategy,
+			preferReady:    true,
+			ready:          map[balancer.SubConn]struct{}{ready: {}},
+		}
+		for _, id := range []string{"1", "2", "3"} {
+			sc := balancer.SubConn(&fakeSubConn{id: id})
+			if id == "2" {
+				sc = ready
+			}
+			require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: sc, stats: newSubConnStats(&total)}))
+		}
+
+		// The only Ready backend is used, however loaded it is.
+		for i := 0; i < 10; i++ {
+			result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), strconv.Itoa(i))})
+			require.NoError(t, err)
+			require.Same(t, ready, result.SubConn, string(strategy))
+		}
+	}
+}
+
+func TestConsistentHashringPickerPickSpreadWeights(t *testing.T) {
+	weights := []float64{0.7, 0.2, 0.1}
+	p := &picker{
+		hashring:      hashring.MustNew(xxhash.Sum64, 100),
+		numMembers:    3,
+		spread:        3,
+		spreadWeights: weights,
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}}))
+	}
+
+	key := []byte("key")
+	members, err := p.hashring.FindN(key, 3)
+	require.NoError(t, err)
+
+	const numPicks = 100_000
+	picks := map[string]int{}
+	info := balancer.PickInfo{Ctx: ContextWithKey(context.Background(), string(key))}
+	for i := 0; i < numPicks; i++ {
+		result, err := p.Pick(info)
+		require.NoError(t, err)
+		picks[result.SubConn.(*fakeSubConn).id]++
+	}
+
+	// Earlier replicas along the hashring are picked in proportion to their
+	// weights.
+	for i, member := range members {
+		fraction := float64(picks[member.Key()]) / numPicks
+		require.InDelta(t, weights[i], fraction, 0.01, "replica %d", i)
+	}
+
+	// A smaller spread only considers the earlier replicas, in proportion.
+	picks = map[string]int{}
+	info = balancer.PickInfo{Ctx: ContextWithSpread(info.Ctx, 2)}
+	for i := 0; i < numPicks; i++ {
+		result, err := p.Pick(info)
+		require.NoError(t, err)
+		picks[result.SubConn.(*fakeSubConn).id]++
+	}
+	require.Zero(t, picks[members[2].Key()])
+	require.InDelta(t, 0.7/0.9, float64(picks[members[0].Key()])/numPicks, 0.01)
+}
+
+func TestConsistentHashringPickerPickSpreadWeightsRand(t *testing.T) {
+	p := &picker{
+		hashring:      hashring.MustNew(xxhash.Sum64, 100),
+		numMembers:    3,
+		spread:        3,
+		spreadWeights: []float64{0.7, 0.2, 0.1},
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}}))
+	}
+
+	key := []byte("key")
+	members, err := p.hashring.FindN(key, 3)
+	require.NoError(t, err)
+	info := balancer.PickInfo{Ctx: ContextWithKey(context.Background(), string(key))}
+
+	// The weighted choice is drawn from the picker's random number generator,
+	// so it's deterministic for a deterministic generator.
+	for _, tt := range []struct {
+		rand func(n uint8) int
+		want hashring.Member
+	}{
+		{func(uint8) int { return 0 }, members[0]},
+		{func(n uint8) int { return int(n) / 2 }, members[0]},
+		{func(n uint8) int { return int(n) * 4 / 5 }, members[1]},
+		{func(n uint8) int { return int(n) - 1 }, members[2]},
+	} {
+		p.rand = tt.rand
+		for i := 0; i < 10; i++ {
+			result, err := p.Pick(info)
+			require.NoError(t, err)
+			require.Same(t, tt.want.(subConnMember).SubConn, result.SubConn)
+		}
+	}
+}
+
+func TestConsistentHashringPickerPickSpreadWeightsPreferReady(t *testing.T) {
+	p := &picker{
+		hashring:      hashring.MustNew(xxhash.Sum64, 100),
+		numMembers:    3,
+		spread:        3,
+		spreadWeights: []float64{1, 0, 0},
+		preferReady:   true,
+		ready:         map[balancer.SubConn]struct{}{},
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		sc := &fakeSubConn{id: id}
+		p.ready[sc] = struct{}{}
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: sc}))
+	}
+
+	key := []byte("key")
+	members, err := p.hashring.FindN(key, 3)
+	require.NoError(t, err)
+
+	info := balancer.PickInfo{Ctx: ContextWithKey(context.Background(), string(key))}
+	for i := 0; i < 100; i++ {
+		result, err := p.Pick(info)
+		require.NoError(t, err)
+		require.Same(t, members[0].(subConnMember).SubConn, result.SubConn)
+	}
+
+	// Without any weight left among the Ready replicas, they're chosen
+	// uniformly.
+	delete(p.ready, members[0].(subConnMember).SubConn)
+	picks := map[balancer.SubConn]int{}
+	for i := 0; i < 100; i++ {
+		result, err := p.Pick(info)
+		require.NoError(t, err)
+		picks[result.SubConn]++
+	}
+	require.Zero(t, picks[members[0].(subConnMember).SubConn])
+	require.Positive(t, picks[members[1].(subConnMember).SubConn])
+	require.Positive(t, picks[members[2].(subConnMember).SubConn])
+}
+
+func TestConsistentHashringPickerPickCache(t *testing.T) {
+	p := &picker{
+		hashring:   hashring.MustNew(xxhash.Sum64, 100),
+		numMembers: 3,
+		spread:     2,
+		cache:      newPickCache(2),
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}}))
+	}
+
+	// Picks from the cached candidates are still spread at random.
+	key := []byte("key")
+	members, err := p.hashring.FindN(key, 2)
+	require.NoError(t, err)
+	info := balancer.PickInfo{Ctx: ContextWithKey(context.Background(), string(key))}
+	picks := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		result, err := p.Pick(info)
+		require.NoError(t, err)
+		picks[result.SubConn.(*fakeSubConn).id]++
+	}
+	require.Len(t, picks, 2)
+	require.Positive(t, picks[members[0].Key()])
+	require.Positive(t, picks[members[1].Key()])
+
+	cached, ok := p.cache.get(key, 2)
+	require.True(t, ok)
+	require.Equal(t, members, cached)
+
+	// A spread override isn't answered with the candidates of another spread.
+	_, ok = p.cache.get(key, 1)
+	require.False(t, ok)
+	result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithSpread(info.Ctx, 1)})
+	require.NoError(t, err)
+	require.Equal(t, members[0].Key(), result.SubConn.(*fakeSubConn).id)
+
+	// The least recently used key is evicted.
+	for _, other := range []string{"other", "another"} {
+		_, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), other)})
+		require.NoError(t, err)
+	}
+	_, ok = p.cache.get(key, 2)
+	require.False(t, ok)
+	_, ok = p.cache.get([]byte("other"), 2)
+	require.True(t, ok)
+	require.Equal(t, 2, p.cache.order.Len())
+	require.Len(t, p.cache.entries, 2)
+}
+
+func TestConsistentHashringBalancerPickCacheInvalidation(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	b := NewBuilder(xxhash.Sum64)
+	cfg, err := b.ParseConfig([]byte(`{"pickCacheSize": 100}`))
+	require.NoError(t, err)
+	bb := b.Build(cc, balancer.BuildOptions{})
+	update := func(addrs ...string) {
+		state := resolver.State{}
+		for _, addr := range addrs {
+			state.Addresses = append(state.Addresses, resolver.Address{ServerName: "t", Addr: addr})
+		}
+		require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{ResolverState: state, BalancerConfig: cfg}))
+	}
+
+	update("1", "2", "3")
+	<-states
+	var p balancer.Picker
+	for _, key := range []string{"t/1", "t/2", "t/3"} {
+		bb.UpdateSubConnState(cc.subConn(key), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+		p = (<-states).Picker
+	}
+
+	// Warm the cache with keys owned by t/1.
+	var keys []string
+	for i := 0; len(keys) < 10; i++ {
+		key := "key" + strconv.Itoa(i)
+		result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), key)})
+		require.NoError(t, err)
+		if result.SubConn.(*fakeSubConn).id == "t/1" {
+			keys = append(keys, key)
+		}
+	}
+	require.NotNil(t, p.(*picker).cache)
+	require.Positive(t, p.(*picker).cache.order.Len())
+
+	// Once t/1 is removed, the rebuilt picker doesn't answer from the old
+	// cache.
+	update("2", "3")
+	p = (<-states).Picker
+	require.Zero(t, p.(*picker).cache.order.Len())
+	for _, key := range keys {
+		result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), key)})
+		require.NoError(t, err)
+		require.NotEqual(t, "t/1", result.SubConn.(*fakeSubConn).id, key)
+	}
+}
+
+func TestConsistentHashringPickerPickBoundedLoadConcurrent(t *testing.T) {
+	var total atomic.Int64
+	p := &picker{
+		hashring:      hashring.MustNew(xxhash.Sum64, 100),
+		numMembers:    3,
+		spread:        1,
+		maxLoadFactor: 1.25,
+		totalInFlight: &total,
+	}
+	stats := make([]*subConnStats, 0, 3)
+	for _, id := range []string{"1", "2", "3"} {
+		s := newSubConnStats(&total)
+		stats = append(stats, s)
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}, stats: s}))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			info := balancer.PickInfo{Ctx: ContextWithKey(context.Background(), strconv.Itoa(g%2))}
+			for i := 0; i < 1000; i++ {
+				result, err := p.Pick(info)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				result.Done(balancer.DoneInfo{})
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	require.Zero(t, total.Load())
+	for _, s := range stats {
+		require.Zero(t, s.inFlight.Load())
+	}
+}
+
+func TestConsistentHashringBalancerEndpoints(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 10, Spread: 1}
+
+	// An endpoint with two addresses is a single member with one subconn.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Endpoints: []resolver.Endpoint{
+				{Addresses: []resolver.Address{{ServerName: "t", Addr: "2"}, {ServerName: "t", Addr: "1"}}},
+				{Addresses: []resolver.Address{{ServerName: "t", Addr: "3"}}},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.ElementsMatch(t, []RingMember{
+		{Key: "t/1,t/2", VirtualNodes: 10},
+		{Key: "t/3", VirtualNodes: 10},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+
+	sc := cc.subConn("t/2")
+	cc.mu.Lock()
+	require.Len(t, cc.subConns, 2)
+	require.Equal(t, []resolver.Address{{ServerName: "t", Addr: "2"}, {ServerName: "t", Addr: "1"}}, cc.subConnAddrs[sc])
+	cc.mu.Unlock()
+
+	// Reordering the endpoint's addresses keeps its identity, and its weight
+	// is read from the endpoint's attributes.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Endpoints: []resolver.Endpoint{
+				{
+					Addresses:  []resolver.Address{{ServerName: "t", Addr: "1"}, {ServerName: "t", Addr: "2"}},
+					Attributes: attributes.New(WeightAttributeKey, uint16(2)),
+				},
+				{Addresses: []resolver.Address{{ServerName: "t", Addr: "3"}}},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.ElementsMatch(t, []RingMember{
+		{Key: "t/1,t/2", VirtualNodes: 20},
+		{Key: "t/3", VirtualNodes: 10},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+
+	cc.mu.Lock()
+	require.Len(t, cc.subConns, 2, "the endpoint shouldn't get a new subconn")
+	cc.mu.Unlock()
+
+	// Without endpoints, each address is its own member.
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "3"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.ElementsMatch(t, []RingMember{
+		{Key: "t/1", VirtualNodes: 10},
+		{Key: "t/3", VirtualNodes: 10},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+
+	sc = cc.subConn("t/1")
+	cc.mu.Lock()
+	require.Len(t, cc.subConns, 2)
+	require.Len(t, cc.subConnAddrs[sc], 1)
+	cc.mu.Unlock()
+}
+
+func TestConsistentHashringBalancerConnectionErrors(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := NewBuilder(xxhash.Sum64).Build(cc, balancer.BuildOptions{})
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+				{ServerName: "t", Addr: "3"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{ReplicationFactor: 100, Spread: 1},
+	}))
+	<-states
+
+	var s balancer.State
+	for _, key := range []string{"t/1", "t/2", "t/3"} {
+		bb.UpdateSubConnState(cc.subConn(key), balancer.SubConnState{
+			ConnectivityState: connectivity.TransientFailure,
+			ConnectionError:   fmt.Errorf("dial %s: connection refused", key),
+		})
+		s = <-states
+	}
+	require.Equal(t, connectivity.TransientFailure, s.ConnectivityState)
+
+	// The picker's error names every backend that failed.
+	_, err := s.Picker.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key")})
+	require.Error(t, err)
+	for _, key := range []string{"t/1", "t/2", "t/3"} {
+		require.ErrorContains(t, err, fmt.Sprintf("%s: dial %s: connection refused", key, key))
+	}
+
+	// A resolver error is reported alongside them.
+	bb.ResolverError(errors.New("resolver unavailable"))
+	s = <-states
+	_, err = s.Picker.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key")})
+	require.ErrorContains(t, err, "t/1: dial t/1")
+	require.ErrorContains(t, err, "resolver unavailable")
+
+	// Once a backend recovers, the hashring is used again and its error is
+	// forgotten.
+	bb.UpdateSubConnState(cc.subConn("t/2"), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	s = <-states
+	require.Equal(t, connectivity.Ready, s.ConnectivityState)
+	require.IsType(t, &picker{}, s.Picker)
+	require.NotContains(t, bb.(*ringBalancer).transientFailureErr().Error(), "t/2")
+}
+
+func TestConsistentHashringBalancerSpreadLargerThanMembers(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := NewBuilder(xxhash.Sum64).Build(cc, balancer.BuildOptions{})
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+				{ServerName: "t", Addr: "3"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{ReplicationFactor: 100, Spread: 5},
+	}))
+	p := (<-states).Picker
+
+	// Every member is a candidate for every key, rather than every pick
+	// failing.
+	ctx := ContextWithKey(context.Background(), "key")
+	picked := make(map[balancer.SubConn]struct{})
+	for i := 0; i < 1000; i++ {
+		result, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		require.NoError(t, err)
+		picked[result.SubConn] = struct{}{}
+	}
+	require.Len(t, picked, 3)
+
+	// The same applies to a per-request override.
+	_, err := p.Pick(balancer.PickInfo{Ctx: ContextWithSpread(ctx, 10)})
+	require.NoError(t, err)
+}
+
+func TestConsistentHashringBalancerFirstReadyBuildsPicker(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := NewBuilder(xxhash.Sum64).Build(cc, balancer.BuildOptions{})
+
+	// The resolver fails before producing any addresses, so the balancer
+	// starts out in TransientFailure with an error picker.
+	bb.ResolverError(errors.New("resolver unavailable"))
+	s := <-states
+	require.Equal(t, connectivity.TransientFailure, s.ConnectivityState)
+
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{ReplicationFactor: 100, Spread: 1},
+	}))
+	s = <-states
+	require.NotEqual(t, connectivity.TransientFailure, s.ConnectivityState, "the new subconns are idle, not failed")
+	require.IsType(t, &picker{}, s.Picker)
+
+	for _, transition := range []struct {
+		key   string
+		state connectivity.State
+	}{
+		{"t/1", connectivity.Idle},
+		{"t/1", connectivity.Connecting},
+		{"t/2", connectivity.Connecting},
+		{"t/1", connectivity.Ready},
+	} {
+		bb.UpdateSubConnState(cc.subConn(transition.key), balancer.SubConnState{ConnectivityState: transition.state})
+		s = <-states
+		require.IsType(t, &picker{}, s.Picker, "after %s became %s", transition.key, transition.state)
+	}
+	require.Equal(t, connectivity.Ready, s.ConnectivityState)
+
+	result, err := s.Picker.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key")})
+	require.NoError(t, err)
+	require.NotNil(t, result.SubConn)
+}
+
+func TestConsistentHashringBalancerRegeneratePicker(t *testing.T) {
+	for _, healthCheck := range []bool{false, true} {
+		healthCheck := healthCheck
+		t.Run(fmt.Sprintf("healthCheck=%t", healthCheck), func(t *testing.T) {
+			cc := newFakeClientConn()
+			states := make(chan balancer.State, 1)
+			go func() {
+				for s := range cc.stateCh {
+					states <- s
+				}
+			}()
+
+			bb := NewBuilder(xxhash.Sum64).Build(cc, balancer.BuildOptions{})
+			require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+				ResolverState: resolver.State{
+					Addresses: []resolver.Address{
+						{ServerName: "t", Addr: "1"},
+						{ServerName: "t", Addr: "2"},
+						{ServerName: "t", Addr: "3"},
+					},
+				},
+				BalancerConfig: &BalancerConfig{ReplicationFactor: 100, Spread: 1, EnableHealthCheck: healthCheck},
+			}))
+			<-states
+
+			var s balancer.State
+			for _, key := range []string{"t/1", "t/2", "t/3"} {
+				bb.UpdateSubConnState(cc.subConn(key), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+				s = <-states
+			}
+			before := s.Picker.(*picker)
+
+			bb.UpdateSubConnState(cc.subConn("t/1"), balancer.SubConnState{
+				ConnectivityState: connectivity.TransientFailure,
+				ConnectionError:   errors.New("connection refused"),
+			})
+			s = <-states
+			require.Equal(t, connectivity.Ready, s.ConnectivityState)
+
+			// The balancer still has ready subconns, so the hashring is used,
+			// but through a new picker.
+			after, ok := s.Picker.(*picker)
+			require.True(t, ok)
+			require.NotSame(t, before, after)
+
+			if healthCheck {
+				require.Contains(t, before.ready, cc.subConn("t/1"))
+				require.NotContains(t, after.ready, cc.subConn("t/1"))
+				require.Len(t, after.ready, 2)
+			}
+		})
+	}
+}
+
+func TestConsistentHashringBalancerPickWait(t *testing.T) {
+	for _, fallback := range []bool{false, true} {
+		fallback := fallback
+		t.Run(fmt.Sprintf("fallback=%t", fallback), func(t *testing.T) {
+			cc := newFakeClientConn()
+			states := make(chan balancer.State, 1)
+			go func() {
+				for s := range cc.stateCh {
+					states <- s
+				}
+			}()
+
+			b := NewBuilder(xxhash.Sum64)
+			bb := b.Build(cc, balancer.BuildOptions{})
+			require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+				ResolverState: resolver.State{
+					Addresses: []resolver.Address{
+						{ServerName: "t", Addr: "1"},
+						{ServerName: "t", Addr: "2"},
+						{ServerName: "t", Addr: "3"},
+					},
+				},
+				BalancerConfig: &BalancerConfig{ReplicationFactor: 100, Spread: 1, PickWait: true, FallbackToNext: fallback},
+			}))
+			<-states
+
+			for _, key := range []string{"t/1", "t/2", "t/3"} {
+				bb.UpdateSubConnState(cc.subConn(key), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+				<-states
+			}
+
+			// t/1 is reconnecting.
+			bb.UpdateSubConnState(cc.subConn("t/1"), balancer.SubConnState{ConnectivityState: connectivity.Idle})
+			<-states
+			bb.UpdateSubConnState(cc.subConn("t/1"), balancer.SubConnState{ConnectivityState: connectivity.Connecting})
+			p := (<-states).Picker
+
+			owners := make(map[string]string, 100)
+			waited := 0
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(i)
+				info := balancer.PickInfo{Ctx: ContextWithKey(context.Background(), key)}
+				result, err := p.Pick(info)
+				if fallback {
+					// Another member takes the request rather than waiting.
+					require.NoError(t, err)
+					require.NotEqual(t, "t/1", result.SubConn.(*fakeSubConn).id)
+					continue
+				}
+				if err != nil {
+					// gRPC blocks the RPC until there's a new picker rather
+					// than failing it.
+					require.Same(t, balancer.ErrNoSubConnAvailable, err)
+					waited++
+					owners[key] = "t/1"
+					continue
+				}
+				require.NotEqual(t, "t/1", result.SubConn.(*fakeSubConn).id)
+				owners[key] = result.SubConn.(*fakeSubConn).id
+			}
+			require.Zero(t, b.(BalancerTracker).LastBalancer().Stats().PickErrors)
+			if fallback {
+				return
+			}
+			require.Positive(t, waited)
+
+			// Once t/1 reconnects, the waiting RPCs are picked again, and
+			// every key goes to its owner.
+			bb.UpdateSubConnState(cc.subConn("t/1"), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+			p = (<-states).Picker
+			for key, owner := range owners {
+				result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), key)})
+				require.NoError(t, err)
+				require.Equal(t, owner, result.SubConn.(*fakeSubConn).id, key)
+			}
+		})
+	}
+}
+
+func BenchmarkPickCache(b *testing.B) {
+	for _, size := range []int{0, 1024} {
+		for _, spread := range []uint8{1, 3} {
+			b.Run(fmt.Sprintf("size=%d/spread=%d", size, spread), func(b *testing.B) {
+				p := &picker{
+					hashring:   hashring.MustNew(xxhash.Sum64, 100),
+					numMembers: 50,
+					spread:     spread,
+				}
+				if size > 0 {
+					p.cache = newPickCache(size)
+				}
+				for i := 0; i < 50; i++ {
+					id := strconv.Itoa(i)
+					require.NoError(b, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}}))
+				}
+
+				// A handful of hot keys, as when bursts of requests share keys.
+				infos := make([]balancer.PickInfo, 16)
+				for i := range infos {
+					infos[i] = balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key"+strconv.Itoa(i))}
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := p.Pick(infos[i%len(infos)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
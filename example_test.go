@@ -0,0 +1,35 @@
+package consistent_test
+
+import (
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/authzed/consistent"
+)
+
+// This example computes which backend the balancer will send a request to,
+// without making an RPC, such as for a client of a distributed cache that
+// also caches entries locally per backend.
+func Example_ownerRing() {
+	// The member keys of the backends, as derived by DefaultMemberKey from
+	// their addresses, and the replication factor of the service config.
+	ring, err := consistent.NewOwnerRing(xxhash.Sum64, 100,
+		"cache/10.0.0.1:6379",
+		"cache/10.0.0.2:6379",
+		"cache/10.0.0.3:6379",
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	// A request made with consistent.ContextWithKey(ctx, "user:1234") goes to
+	// the same backend.
+	owner, err := ring.Find([]byte("user:1234"))
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(owner.Key())
+	// Output: cache/10.0.0.1:6379
+}
@@ -0,0 +1,38 @@
+package consistent
+
+import (
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/authzed/consistent/hashring"
+)
+
+var (
+	hashFuncsMu sync.RWMutex
+	hashFuncs   = map[string]hashring.HashFunc{
+		"xxhash": xxhash.Sum64,
+		"sha256": hashring.SHA256,
+	}
+)
+
+// RegisterHashFunc makes a hash function available by name to the HashFunc
+// field of BalancerConfig, replacing any hash function previously registered
+// with the same name.
+//
+// "xxhash" and "sha256" are registered by default; see the hashring package
+// for their tradeoffs.
+func RegisterHashFunc(name string, fn hashring.HashFunc) {
+	hashFuncsMu.Lock()
+	defer hashFuncsMu.Unlock()
+
+	hashFuncs[name] = fn
+}
+
+func lookupHashFunc(name string) (hashring.HashFunc, bool) {
+	hashFuncsMu.RLock()
+	defer hashFuncsMu.RUnlock()
+
+	fn, ok := hashFuncs[name]
+	return fn, ok
+}
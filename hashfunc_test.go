@@ -0,0 +1,108 @@
+package consistent
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/authzed/consistent/hashring"
+)
+
+func TestParseConfigHashFunc(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+
+	cfg, err := b.ParseConfig([]byte(`{"hashFunc": "sha256"}`))
+	require.NoError(t, err)
+	require.Equal(t, "sha256", cfg.(*BalancerConfig).HashFunc)
+
+	_, err = b.ParseConfig([]byte(`{"hashFunc": "unknown"}`))
+	require.ErrorContains(t, err, `unknown hash function "unknown"`)
+
+	cfg, err = b.ParseConfig([]byte(`{}`))
+	require.NoError(t, err)
+	require.Empty(t, cfg.(*BalancerConfig).HashFunc)
+}
+
+func TestConsistentHashringBalancerHashFunc(t *testing.T) {
+	var builderCalls, registeredCalls atomic.Int64
+	builderHash := func(b []byte) uint64 {
+		builderCalls.Add(1)
+		return xxhash.Sum64(b)
+	}
+	RegisterHashFunc("test-counting", func(b []byte) uint64 {
+		registeredCalls.Add(1)
+		return hashring.FNV1a64(b)
+	})
+
+	tests := []struct {
+		name     string
+		hashFunc string
+		expected hashring.HashFunc
+		calls    *atomic.Int64
+	}{
+		{"default", "", xxhash.Sum64, &builderCalls},
+		{"registered", "test-counting", hashring.FNV1a64, &registeredCalls},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := newFakeClientConn()
+			states := make(chan balancer.State, 1)
+			go func() {
+				for s := range cc.stateCh {
+					states <- s
+				}
+			}()
+
+			bb := NewBuilder(builderHash).Build(cc, balancer.BuildOptions{})
+			require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+				ResolverState: resolver.State{
+					Addresses: []resolver.Address{
+						{ServerName: "t", Addr: "1"},
+						{ServerName: "t", Addr: "2"},
+						{ServerName: "t", Addr: "3"},
+					},
+				},
+				BalancerConfig: &BalancerConfig{
+					ReplicationFactor: 100,
+					Spread:            1,
+					HashFunc:          tt.hashFunc,
+				},
+			}))
+			p := (<-states).Picker.(*picker)
+			require.Positive(t, tt.calls.Load())
+
+			expected := hashring.MustNew(tt.expected, 100)
+			for _, key := range []string{"t/1", "t/2", "t/3"} {
+				require.NoError(t, expected.Add(subConnMember{key: key, SubConn: cc.subConn(key)}))
+			}
+
+			for i := 0; i < 100; i++ {
+				key := []byte(strconv.Itoa(i))
+				owner, err := expected.Find(key)
+				require.NoError(t, err)
+
+				got, err := p.Pick(balancer.PickInfo{Ctx: context.WithValue(context.Background(), CtxKey, key)})
+				require.NoError(t, err)
+				require.Same(t, owner.(subConnMember).SubConn, got.SubConn)
+			}
+		})
+	}
+}
+
+func TestConsistentHashringBalancerUnknownHashFunc(t *testing.T) {
+	bb := NewBuilder(xxhash.Sum64).Build(newFakeClientConn(), balancer.BuildOptions{})
+	err := bb.UpdateClientConnState(balancer.ClientConnState{
+		BalancerConfig: &BalancerConfig{
+			ReplicationFactor: 100,
+			Spread:            1,
+			HashFunc:          "unknown",
+		},
+	})
+	require.ErrorContains(t, err, `unknown hash function "unknown"`)
+}
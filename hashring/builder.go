@@ -0,0 +1,70 @@
+package hashring
+
+// DefaultReplicationFactor is the replication factor used by a Builder unless
+// WithReplicationFactor is provided. See New for guidance on choosing one.
+const DefaultReplicationFactor = 100
+
+// Builder creates Rings without requiring callers to choose a replication
+// factor up front, which makes it a convenient entrypoint for using the
+// hashring outside of gRPC.
+type Builder struct {
+	hashfn               HashFunc
+	replicationFactor    uint16
+	maxReplicationFactor uint16
+}
+
+// BuilderOption customizes a Builder created by NewBuilder.
+type BuilderOption func(*Builder)
+
+// WithReplicationFactor sets the number of virtual nodes per member of the
+// Rings that are built.
+//
+// Defaults to DefaultReplicationFactor.
+func WithReplicationFactor(replicationFactor uint16) BuilderOption {
+	return func(b *Builder) {
+		b.replicationFactor = replicationFactor
+	}
+}
+
+// WithMaxReplicationFactor sets the largest replication factor accepted by
+// the Rings that are built, as with NewWithMaxReplicationFactor.
+//
+// Defaults to 0, which means there's no limit.
+func WithMaxReplicationFactor(maxReplicationFactor uint16) BuilderOption {
+	return func(b *Builder) {
+		b.maxReplicationFactor = maxReplicationFactor
+	}
+}
+
+// NewBuilder allocates a Builder for Rings using the specified hash function.
+func NewBuilder(hashfn HashFunc, opts ...BuilderOption) *Builder {
+	b := &Builder{
+		hashfn:            hashfn,
+		replicationFactor: DefaultReplicationFactor,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// Build allocates a Ring containing the provided members.
+//
+// If the replication factor is invalid, ErrInvalidReplicationFactor is
+// returned, and if it's greater than the maximum set with
+// WithMaxReplicationFactor, ErrReplicationFactorTooLarge is returned. If any
+// members share a key, ErrMemberAlreadyExists is returned.
+func (b *Builder) Build(members ...Member) (*Ring, error) {
+	ring, err := NewWithMaxReplicationFactor(b.hashfn, b.replicationFactor, b.maxReplicationFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ring.AddMany(members); err != nil {
+		return nil, err
+	}
+
+	return ring, nil
+}
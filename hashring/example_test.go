@@ -0,0 +1,49 @@
+package hashring_test
+
+import (
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/authzed/consistent/hashring"
+)
+
+type backend string
+
+func (b backend) Key() string { return string(b) }
+
+// This example uses a hashring to assign keys to cache servers without any
+// gRPC machinery.
+func Example_standalone() {
+	ring, err := hashring.NewBuilder(xxhash.Sum64).Build(backend("cache-a"), backend("cache-b"))
+	if err != nil {
+		panic(err)
+	}
+
+	if err := ring.Add(backend("cache-c")); err != nil {
+		panic(err)
+	}
+
+	owner, err := ring.Find([]byte("user:1234"))
+	if err != nil {
+		panic(err)
+	}
+
+	// Removing a backend only moves the keys it owned.
+	for _, b := range []backend{"cache-a", "cache-b", "cache-c"} {
+		if b != owner {
+			if err := ring.Remove(b); err != nil {
+				panic(err)
+			}
+			break
+		}
+	}
+
+	after, err := ring.Find([]byte("user:1234"))
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(owner == after, ring.Size())
+	// Output: true 2
+}
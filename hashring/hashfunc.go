@@ -0,0 +1,82 @@
+package hashring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// The following HashFuncs are ready to pass to New or NewBuilder. Each is
+// stateless and safe for concurrent use.
+//
+// XXHash is the recommended default: it's the fastest of them and distributes
+// keys evenly. SHA256 distributes keys just as evenly and is stable across
+// languages and implementations, but is several times slower; prefer it only
+// when hashes must match another system or keys may be chosen adversarially.
+//
+// FNV1a64 depends only on the standard library and is fast for short keys, but
+// barely mixes the final bytes of its input. Since the virtual nodes of a Ring
+// member are hashed from inputs that differ only in their final bytes, a Ring
+// using FNV1a64 clusters each member's virtual nodes together and distributes
+// keys very unevenly regardless of replication factor. It's provided for
+// compatibility with systems that already use FNV-1a, and should otherwise be
+// avoided.
+var (
+	_ HashFunc = XXHash
+	_ HashFunc = FNV1a64
+	_ HashFunc = SHA256
+)
+
+// XXHash returns the 64-bit xxHash (XXH64) of key.
+func XXHash(key []byte) uint64 {
+	return xxhash.Sum64(key)
+}
+
+const (
+	fnv1a64Offset = 14695981039346656037
+	fnv1a64Prime  = 1099511628211
+)
+
+// FNV1a64 returns the 64-bit FNV-1a hash of key, matching hash/fnv's New64a
+// without allocating.
+func FNV1a64(key []byte) uint64 {
+	hash := uint64(fnv1a64Offset)
+	for _, c := range key {
+		hash ^= uint64(c)
+		hash *= fnv1a64Prime
+	}
+	return hash
+}
+
+// SHA256 returns the first 8 bytes of the SHA-256 digest of key, interpreted
+// as a big-endian integer.
+func SHA256(key []byte) uint64 {
+	digest := sha256.Sum256(key)
+	return binary.BigEndian.Uint64(digest[:8])
+}
+
+// SeededHashFunc returns a HashFunc that mixes seed into every hash computed
+// by hashfn, such as to give several rings over the same members and keys
+// independent placements. See NewSeeded.
+//
+// Each seed scrambles hashfn's output with a different bijection, so the
+// seeded hashes are spread exactly as evenly as hashfn's own, and the
+// function is stateless and safe for concurrent use if hashfn is. A seed of 0
+// still differs from hashfn itself.
+func SeededHashFunc(hashfn HashFunc, seed uint64) HashFunc {
+	return func(key []byte) uint64 {
+		return mix64(hashfn(key) ^ seed)
+	}
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads every bit of x over
+// every bit of the result.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
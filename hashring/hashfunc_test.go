@@ -0,0 +1,93 @@
+package hashring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"strconv"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+var hashFuncs = []struct {
+	name   string
+	hashfn HashFunc
+
+	// tolerance is the largest acceptable relative deviation from an even
+	// distribution across buckets of the raw hashes.
+	tolerance float64
+
+	// evenRing is whether keys are expected to be spread evenly over the
+	// members of a Ring using the hash function.
+	evenRing bool
+}{
+	{"xxhash", XXHash, 0.05, true},
+	{"fnv1a64", FNV1a64, 0.15, false}, // clusters vnodes; see FNV1a64
+	{"sha256", SHA256, 0.05, true},
+	{"seeded xxhash", SeededHashFunc(XXHash, 42), 0.05, true},
+	{"seeded fnv1a64", SeededHashFunc(FNV1a64, 42), 0.05, true}, // the seed mixes away FNV1a64's clustering
+}
+
+func TestHashFuncs(t *testing.T) {
+	for _, key := range []string{"", "a", "key", "some-longer-key-0123456789"} {
+		require.Equal(t, xxhash.Sum64String(key), XXHash([]byte(key)))
+
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		require.Equal(t, h.Sum64(), FNV1a64([]byte(key)))
+
+		digest := sha256.Sum256([]byte(key))
+		require.Equal(t, binary.BigEndian.Uint64(digest[:]), SHA256([]byte(key)))
+	}
+}
+
+func TestHashFuncDistribution(t *testing.T) {
+	const (
+		numKeys    = 1_000_000
+		numMembers = 10
+	)
+
+	for _, tc := range hashFuncs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ring, err := New(tc.hashfn, 1000)
+			require.NoError(t, err)
+			for memberNum := 0; memberNum < numMembers; memberNum++ {
+				require.NoError(t, ring.Add(member(memberNum)))
+			}
+
+			// Bucketing the raw hashes checks the hash function on its own;
+			// the hashring's placement checks it together with vnode hashing.
+			var buckets [64]int
+			counts := make(map[string]int, numMembers)
+			key := make([]byte, 0, 16)
+			for i := 0; i < numKeys; i++ {
+				key = strconv.AppendInt(key[:0], int64(i), 10)
+				buckets[tc.hashfn(key)>>58]++
+
+				found, err := ring.Find(key)
+				require.NoError(t, err)
+				counts[found.Key()]++
+			}
+
+			expectedPerBucket := float64(numKeys) / float64(len(buckets))
+			for bucket, count := range buckets {
+				require.InEpsilon(t, expectedPerBucket, float64(count), tc.tolerance, "bucket %d", bucket)
+			}
+
+			if !tc.evenRing {
+				return
+			}
+
+			require.Len(t, counts, numMembers)
+			expectedPerMember := float64(numKeys) / numMembers
+			for key, count := range counts {
+				require.InEpsilon(t, expectedPerMember, float64(count), 0.1, "member %s", key)
+			}
+		})
+	}
+}
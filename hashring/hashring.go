@@ -1,28 +1,41 @@
 // Package hashring implements a thread-safe consistent hashring with a
 // pluggable hashing algorithm.
 //
+// Rendezvous hashing and jump hashing implementations are also provided for
+// small or ordered member sets; all of them satisfy the Hasher interface.
+//
 // This package was developed for use in a gRPC balancer, but nothing precludes
-// it from being used for any other purpose.
+// it from being used for any other purpose. NewBuilder is the simplest way to
+// create a Ring for use on its own.
 package hashring
 
 import (
+	"cmp"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
-
-	"golang.org/x/exp/slices"
+	"sync/atomic"
 )
 
 var (
-	ErrMemberAlreadyExists      = errors.New("member node already exists")
-	ErrMemberNotFound           = errors.New("member node not found")
-	ErrNotEnoughMembers         = errors.New("not enough member nodes to satisfy request")
-	ErrInvalidReplicationFactor = errors.New("replication factor must be at least 1")
-	ErrVnodeNotFound            = errors.New("vnode not found")
-	ErrUnexpectedVnodeCount     = errors.New("found a different number of vnodes than replication factor")
+	ErrMemberAlreadyExists       = errors.New("member node already exists")
+	ErrMemberNotFound            = errors.New("member node not found")
+	ErrNotEnoughMembers          = errors.New("not enough member nodes to satisfy request")
+	ErrInvalidReplicationFactor  = errors.New("replication factor must be at least 1")
+	ErrReplicationFactorTooLarge = errors.New("replication factor exceeds the hashring's maximum")
+	ErrVnodeNotFound             = errors.New("vnode not found")
+	ErrUnexpectedVnodeCount      = errors.New("found a different number of vnodes than replication factor")
+	ErrNotLastMember             = errors.New("only the last member can be removed")
+	ErrInvalidWeight             = errors.New("weight must be at least 1 and at most math.MaxUint16 vnodes per member")
+	ErrVnodesUnsorted            = errors.New("vnodes are not sorted")
+	ErrEmptyMemberKey            = errors.New("member key is empty")
 )
 
 // HashFunc is the signature for any hashing function that can be leveraged by
@@ -35,15 +48,144 @@ type Member interface {
 	Key() string
 }
 
+// IdentifiedMember is a Member that is distinguished from other members by an
+// ID rather than by its key, which lets several members share a key.
+//
+// The key is still what's hashed to place the member on the hashring, so
+// members with the same key have virtual nodes at exactly the same positions.
+// Of those members, the one whose ID sorts first owns the keys that hash to
+// those positions, and the others follow it in the results of FindN. Wherever
+// a Ring identifies a member by string, such as in RemoveByKey, exclusions,
+// and Observer notifications, it uses the ID of an IdentifiedMember.
+type IdentifiedMember interface {
+	Member
+	ID() string
+}
+
+// memberID returns the string that distinguishes member from other members:
+// its ID if it's an IdentifiedMember and its key otherwise.
+func memberID(member Member) string {
+	if identified, ok := member.(IdentifiedMember); ok {
+		return identified.ID()
+	}
+	return member.Key()
+}
+
+// alias is the Member recorded for an alias added by AddAlias, which
+// occupies positions on the hashring like a member with its key but resolves
+// to its target.
+type alias struct {
+	key    string
+	target Member
+}
+
+func (a alias) Key() string {
+	return a.key
+}
+
+// WeightedMember is a Member that carries its own weight, which ReplaceAll
+// uses in place of a weight passed to AddWeighted or SetWeight.
+type WeightedMember interface {
+	Member
+	Weight() uint16
+}
+
+// ZonedMember is a Member that belongs to an availability zone, which
+// FindNAcrossZones uses to spread the members it finds across zones.
+type ZonedMember interface {
+	Member
+	Zone() string
+}
+
+// Comparator orders two distinct members whose virtual nodes have the same
+// hash. The member that sorts first owns the keys that hash to the virtual
+// node.
+//
+// It must return a negative number when a should sort before b, a positive
+// number when a should sort after b, and zero when there's no preference, in
+// which case ties are broken by member key.
+type Comparator func(a, b Member) int
+
+// Hasher is the interface shared by the consistent hashing implementations in
+// this package.
+type Hasher interface {
+	// Add inserts a member.
+	Add(member Member) error
+
+	// Remove removes a member.
+	Remove(member Member) error
+
+	// Find finds the member that owns the specified key.
+	Find(key []byte) (Member, error)
+
+	// FindN finds the N members that own the specified key, in order of
+	// preference.
+	FindN(key []byte, num uint8) ([]Member, error)
+
+	// Members enumerates the full set of members.
+	Members() []Member
+}
+
+var _ Hasher = (*Ring)(nil)
+
+// Observer is notified of changes to the membership of a Ring.
+//
+// Observer methods are called after the change has been applied, while the
+// Ring's write lock is still held. This guarantees that events are delivered
+// in the order the changes were made, but means an Observer must not call
+// methods that modify the Ring (such as Add or Remove), or it will deadlock.
+// Methods that only read the Ring, such as FindN and Members, are safe to call.
+type Observer interface {
+	OnAdd(key string)
+	OnRemove(key string)
+}
+
 // Ring provides a thread-safe consistent hashring implementation with a
 // configurable number of virtual nodes.
+//
+// Reads are lock-free: the ring's state is an immutable snapshot that writers
+// replace wholesale while holding the write lock.
 type Ring struct {
-	hashfn            HashFunc
-	replicationFactor uint16
+	replicationFactor    uint16
+	maxReplicationFactor uint16      // the largest replication factor accepted; unlimited when 0
+	tieBreak             Comparator  // orders members with colliding vnodes; may be nil
+	vnodeHasher          VnodeHasher // derives vnode hashes; the binary scheme is used when nil
 
 	sync.RWMutex
-	nodes        map[string]nodeRecord
+	snapshot   atomic.Pointer[ringSnapshot]
+	observer   Observer
+	collisions int
+}
+
+// ringSnapshot is the state of a Ring at a point in time.
+//
+// A ringSnapshot must never be modified once it has been stored in a Ring.
+type ringSnapshot struct {
+	hashfn       HashFunc
+	nodes        map[string]*nodeRecord
 	virtualNodes []virtualNode
+	draining     map[string]struct{} // IDs of members that aren't assigned keys; may be nil
+	aliases      int                 // number of records in nodes that are aliases
+}
+
+// size returns the number of members in the snapshot, not counting aliases.
+func (s *ringSnapshot) size() int {
+	return len(s.nodes) - s.aliases
+}
+
+// member returns the record of the member with the specified ID, which is
+// never an alias.
+func (s *ringSnapshot) member(nodeID string) (*nodeRecord, bool) {
+	record, ok := s.nodes[nodeID]
+	if !ok || record.target != nil {
+		return nil, false
+	}
+	return record, true
+}
+
+// load returns the current snapshot of the ring.
+func (h *Ring) load() *ringSnapshot {
+	return h.snapshot.Load()
 }
 
 // MustNew creates a new Hashring with the specified hasher function and
@@ -62,201 +204,2041 @@ func MustNew(hasher HashFunc, replicationFactor uint16) *Ring {
 // New allocates a Ring with the specified hash function and replication factor.
 //
 // The replication factor must be greater than 0 and ideally be at least 20 or
-// higher for quality key distribution. At 100, the standard distribution of
-// key->member mapping will be about 10% of the mean. At 1000, it will be about
-// 3.2%. This value should be chosen very carefully because a higher value will
-// require more memory and decrease member selection performance.
+// higher for quality key distribution. The standard deviation of the number of
+// keys mapped to each member is about 22% of the mean at 20, about 10% at 100,
+// and about 3% at 1000, shrinking roughly with the square root of the
+// replication factor. This value should be chosen very carefully because a
+// higher value will require more memory and decrease member selection
+// performance.
+//
+// If the replication factor is less than 1, ErrInvalidReplicationFactor is
+// returned.
 func New(hashfn HashFunc, replicationFactor uint16) (*Ring, error) {
 	if replicationFactor < 1 {
 		return nil, ErrInvalidReplicationFactor
 	}
 
-	return &Ring{
-		hashfn:            hashfn,
+	ring := &Ring{
 		replicationFactor: replicationFactor,
-		nodes:             map[string]nodeRecord{},
-	}, nil
+	}
+	ring.snapshot.Store(&ringSnapshot{hashfn: hashfn, nodes: map[string]*nodeRecord{}})
+
+	return ring, nil
+}
+
+// NewWithComparator allocates a Ring like New, but uses comparator to decide
+// which member owns the keys of virtual nodes whose hashes collide.
+//
+// Collisions are rare with a good hash function, so the comparator doesn't
+// change the placement of keys in the common case.
+func NewWithComparator(hashfn HashFunc, replicationFactor uint16, comparator Comparator) (*Ring, error) {
+	ring, err := New(hashfn, replicationFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	ring.tieBreak = comparator
+
+	return ring, nil
+}
+
+// NewWithMaxReplicationFactor allocates a Ring like New, but rejects
+// replication factors greater than maxReplicationFactor, both when it's
+// allocated and when SetReplicationFactor or IncreaseReplicationFactor change
+// it, such as to guard against replication factors from configuration that
+// would exhaust memory. A maxReplicationFactor of 0 means there's no limit.
+//
+// If the replication factor is greater than maxReplicationFactor,
+// ErrReplicationFactorTooLarge is returned.
+func NewWithMaxReplicationFactor(hashfn HashFunc, replicationFactor, maxReplicationFactor uint16) (*Ring, error) {
+	ring, err := New(hashfn, replicationFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	ring.maxReplicationFactor = maxReplicationFactor
+	if ring.replicationFactorTooLarge(uint32(replicationFactor)) {
+		return nil, ErrReplicationFactorTooLarge
+	}
+
+	return ring, nil
+}
+
+// replicationFactorTooLarge reports whether replicationFactor is greater than
+// the ring accepts.
+func (h *Ring) replicationFactorTooLarge(replicationFactor uint32) bool {
+	limit := uint32(math.MaxUint16)
+	if h.maxReplicationFactor != 0 {
+		limit = uint32(h.maxReplicationFactor)
+	}
+	return replicationFactor > limit
+}
+
+// VnodeHasher derives the hash that places a virtual node of a member in the
+// hashring from the ring's hash function, the hash of the member's key, the
+// key itself, and the index of the virtual node among the member's, which
+// counts up from 0. The hash function is the one the ring currently uses, so
+// a VnodeHasher that hashes with it follows the ring through Rehash.
+//
+// By default, a virtual node's hash is the ring's hash function applied to the
+// 8-byte little-endian hash of the member's key followed by the 2-byte
+// little-endian index.
+type VnodeHasher func(hashfn HashFunc, nodeHash uint64, nodeKey string, replica uint16) uint64
+
+// StringVnodeHasher is a VnodeHasher that applies hashfn to the member's key
+// followed by "#" and the decimal index of the virtual node, such as
+// "node-1#42", a scheme that some hash functions distribute more evenly than
+// the default binary one.
+func StringVnodeHasher(hashfn HashFunc, _ uint64, nodeKey string, replica uint16) uint64 {
+	buffer := make([]byte, 0, len(nodeKey)+6)
+	buffer = append(buffer, nodeKey...)
+	buffer = append(buffer, '#')
+	buffer = strconv.AppendUint(buffer, uint64(replica), 10)
+	return hashfn(buffer)
+}
+
+// NewWithVnodeHasher allocates a Ring like New, but places virtual nodes
+// using the hashes derived by vnodeHasher rather than the default scheme.
+//
+// Changing the scheme places every virtual node differently, which remaps
+// nearly every key, so every client that must agree on the owner of a key
+// must use the same one. The scheme is kept by Rehash, which passes the new
+// hash function to vnodeHasher along with the hashes of members' keys under
+// it.
+func NewWithVnodeHasher(hashfn HashFunc, replicationFactor uint16, vnodeHasher VnodeHasher) (*Ring, error) {
+	ring, err := New(hashfn, replicationFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	ring.vnodeHasher = vnodeHasher
+
+	return ring, nil
+}
+
+// NewSeeded creates a new Ring like New, but mixes seed into the hashes of
+// both the keys and the virtual nodes, as SeededHashFunc does.
+//
+// Rings with the same hash function, replication factor, and members but
+// different seeds place keys independently of each other, so a key that's
+// hot in one ring is no more likely than any other key to land on the same
+// member in another, while each ring on its own is as consistent and as
+// balanced as an unseeded one. Rings with the same seed place keys
+// identically. Rehash replaces the seeded hash function; pass it another
+// SeededHashFunc to keep a seed.
+func NewSeeded(hashfn HashFunc, replicationFactor uint16, seed uint64) (*Ring, error) {
+	return New(SeededHashFunc(hashfn, seed), replicationFactor)
+}
+
+// NewWithMembers allocates a Ring like New that already contains members,
+// placing all of their virtual nodes with a single sort, which is faster than
+// adding them one at a time.
+//
+// Members that are WeightedMembers have the weight they report, and others
+// have a weight of 1. If several members have the same ID, a member's weight
+// is invalid, or a member's key is empty, an error joining
+// ErrMemberAlreadyExists, ErrInvalidWeight, or ErrEmptyMemberKey for each such
+// member is returned.
+func NewWithMembers(hashfn HashFunc, replicationFactor uint16, members []Member) (*Ring, error) {
+	ring, err := New(hashfn, replicationFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replacing the members of an empty ring adds them all at once, and
+	// unlike AddMany, reports every duplicate.
+	if err := ring.ReplaceAll(members); err != nil {
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+// Clone returns an independent copy of the ring that can be modified without
+// affecting the original, such as to plan the effect of adding a member.
+//
+// The hash function is shared and the Observer is not copied. Because
+// snapshots are never modified once stored, the clone starts out sharing the
+// current snapshot and diverges from the original on its first modification.
+func (h *Ring) Clone() *Ring {
+	h.RLock()
+	defer h.RUnlock()
+
+	clone := &Ring{
+		replicationFactor:    h.replicationFactor,
+		maxReplicationFactor: h.maxReplicationFactor,
+		tieBreak:             h.tieBreak,
+		vnodeHasher:          h.vnodeHasher,
+	}
+	clone.snapshot.Store(h.load())
+
+	return clone
+}
+
+// RingView is an immutable view of a Ring at the point in time it was taken
+// with View. It's safe for concurrent use and never changes, however the
+// Ring it was taken from is modified afterwards.
+type RingView struct {
+	snapshot *ringSnapshot
+}
+
+// View returns a RingView of the current state of the ring.
+//
+// Reads on a Ring never block writers, but each one sees whatever state the
+// Ring is in when it's called. A RingView lets batch jobs, such as computing
+// the owners of many sample keys, see one consistent state across all of
+// their reads without copying the ring or holding up membership changes.
+// Taking a view doesn't allocate anything beyond the RingView itself.
+func (h *Ring) View() *RingView {
+	return &RingView{snapshot: h.load()}
+}
+
+// Find finds the first member after the specified key, like Ring.Find.
+func (v *RingView) Find(key []byte) (Member, error) {
+	return v.snapshot.find(v.snapshot.hashfn(key))
+}
+
+// FindN finds the first N members after the specified key, like Ring.FindN.
+func (v *RingView) FindN(key []byte, num uint8) ([]Member, error) {
+	return v.snapshot.findN(context.Background(), v.snapshot.hashfn(key), num, nil)
+}
+
+// Size returns the number of members in the view.
+func (v *RingView) Size() int {
+	return v.snapshot.size()
+}
+
+// Members enumerates the full set of members in the view.
+func (v *RingView) Members() []Member {
+	members := make([]Member, 0, v.snapshot.size())
+	for _, nodeInfo := range v.snapshot.nodes {
+		if nodeInfo.target == nil {
+			members = append(members, nodeInfo.member)
+		}
+	}
+	return members
+}
+
+// SetObserver registers an Observer to be notified of membership changes,
+// replacing any previously registered Observer.
+//
+// Passing nil unregisters the current Observer.
+func (h *Ring) SetObserver(observer Observer) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.observer = observer
 }
 
 // Add inserts a member into the hashring.
 //
 // If a member with the same key is already in the hashring,
-// ErrMemberAlreadyExists is returned.
+// ErrMemberAlreadyExists is returned. If the member's key is empty, which
+// usually means it was built from a blank address, ErrEmptyMemberKey is
+// returned; members with empty keys were accepted by earlier versions, so
+// code that relied on that must give them a non-empty key instead.
 func (h *Ring) Add(member Member) error {
-	nodeKeyString := member.Key()
-	nodeHash := h.hashfn([]byte(nodeKeyString))
-	newNodeRecord := nodeRecord{
-		nodeHash,
-		nodeKeyString,
-		member,
-		nil,
+	return h.AddWeighted(member, 1)
+}
+
+// AddAlias inserts an alias with the specified key that resolves to the
+// member target, such as to route the keys near one position on the hashring
+// to a different backend during a migration.
+//
+// The alias's virtual nodes are placed exactly where those of a member with
+// the same key would be, but the keys they own are resolved to target by
+// Find, FindN, and the other lookups, which treat the alias and target as the
+// same member and never return target twice. The alias is identified by key,
+// so RemoveByKey(key) removes it, which restores the placement the hashring
+// would have without it. To override where an existing member's keys go,
+// remove that member and add an alias with its key, which takes over exactly
+// the keys it owned; removing the alias and adding the member back reverses
+// the override.
+//
+// An alias isn't a member: it isn't listed by Members or counted by Size,
+// Observers aren't notified of it, and it can't be weighted or drained on its
+// own. Excluding or draining target also excludes or drains the alias, and
+// removing target removes every alias that resolves to it. Methods that
+// describe the structure of the hashring rather than resolve keys, such as
+// LoadDistribution and WalkVnodes, report the alias under its own key.
+//
+// If target isn't a member of the hashring, ErrMemberNotFound is returned. If
+// a member or alias with the same key is already in the hashring,
+// ErrMemberAlreadyExists is returned, and if key is empty, ErrEmptyMemberKey
+// is returned.
+func (h *Ring) AddAlias(key string, target Member) error {
+	if key == "" {
+		return ErrEmptyMemberKey
 	}
 
 	h.Lock()
 	defer h.Unlock()
 
-	if _, ok := h.nodes[nodeKeyString]; ok {
+	current := h.load()
+	targetRecord, ok := current.member(memberID(target))
+	if !ok {
+		return ErrMemberNotFound
+	}
+	if _, ok := current.nodes[key]; ok {
 		return ErrMemberAlreadyExists
 	}
 
-	// virtualNodeBuffer is a 10-byte array, where 8 bytes are the hash value of
-	// the member key, and the final 2 bytes are an offset of the virtual node
-	// itself. This value is then hashed to get the final hash value of the virtual node.
-	virtualNodeBuffer := make([]byte, 10)
-	binary.LittleEndian.PutUint64(virtualNodeBuffer, nodeHash)
+	newNodeRecord := h.newNodeRecord(current.hashfn, alias{key: key, target: targetRecord.member}, 1, make([]byte, virtualNodeBufferSize))
+	h.collisions += countCollisions(current.virtualNodes, newNodeRecord.virtualNodes)
 
-	for i := uint16(0); i < h.replicationFactor; i++ {
-		binary.LittleEndian.PutUint16(virtualNodeBuffer[8:], i)
-		virtualNodeHash := h.hashfn(virtualNodeBuffer)
+	next := &ringSnapshot{
+		hashfn:       current.hashfn,
+		nodes:        copyNodes(current.nodes, len(current.nodes)+1),
+		virtualNodes: mergeVnodes(current.virtualNodes, newNodeRecord.virtualNodes, h.cmpVnode),
+		draining:     current.draining,
+		aliases:      current.aliases + 1,
+	}
+	next.nodes[key] = newNodeRecord
 
-		virtualNode := virtualNode{
-			virtualNodeHash,
-			newNodeRecord,
-		}
+	h.snapshot.Store(next)
 
-		newNodeRecord.virtualNodes = append(newNodeRecord.virtualNodes, virtualNode)
-		h.virtualNodes = append(h.virtualNodes, virtualNode)
+	return nil
+}
+
+// AddWeighted inserts a member into the hashring with weight times the
+// replication factor virtual nodes, so that it's assigned a proportionally
+// larger share of keys.
+//
+// If the weight is 0 or would give the member more than math.MaxUint16 virtual
+// nodes, ErrInvalidWeight is returned. If a member with the same key is already
+// in the hashring, ErrMemberAlreadyExists is returned. If the member's key is
+// empty, ErrEmptyMemberKey is returned.
+func (h *Ring) AddWeighted(member Member, weight uint16) error {
+	if member.Key() == "" {
+		return ErrEmptyMemberKey
+	}
+
+	nodeID := memberID(member)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if !validWeight(h.replicationFactor, weight) {
+		return ErrInvalidWeight
 	}
 
-	slices.SortFunc(h.virtualNodes, cmpVnode)
+	current := h.load()
+	if _, ok := current.nodes[nodeID]; ok {
+		return ErrMemberAlreadyExists
+	}
+
+	// Rather than re-sorting the entire ring, merge the new member's already
+	// sorted vnodes into the already sorted ring.
+	newNodeRecord := h.newNodeRecord(current.hashfn, member, weight, make([]byte, virtualNodeBufferSize))
+	h.collisions += countCollisions(current.virtualNodes, newNodeRecord.virtualNodes)
+
+	next := &ringSnapshot{
+		hashfn:       current.hashfn,
+		nodes:        copyNodes(current.nodes, len(current.nodes)+1),
+		virtualNodes: mergeVnodes(current.virtualNodes, newNodeRecord.virtualNodes, h.cmpVnode),
+		draining:     current.draining,
+		aliases:      current.aliases,
+	}
 
 	// Add the node to our map of nodes
-	h.nodes[nodeKeyString] = newNodeRecord
+	next.nodes[nodeID] = newNodeRecord
+
+	h.snapshot.Store(next)
+
+	if h.observer != nil {
+		h.observer.OnAdd(nodeID)
+	}
 
 	return nil
 }
 
-// Remove finds and removes the specified member from the hashring.
+// AddMany inserts several members into the hashring at once.
 //
-// If no member can be found, ErrMemberNotFound is returned.
-func (h *Ring) Remove(member Member) error {
-	nodeKeyString := member.Key()
-
+// It's faster than calling Add for each member when building a large ring,
+// since the ring's virtual nodes are allocated and sorted just once. If any
+// member has the same key as a member already in the hashring or another
+// member being added, ErrMemberAlreadyExists is returned and no members are
+// added. Likewise, if any member's key is empty, ErrEmptyMemberKey is returned.
+func (h *Ring) AddMany(members []Member) error {
 	h.Lock()
 	defer h.Unlock()
 
-	foundNode, ok := h.nodes[nodeKeyString]
-	if !ok {
-		return ErrMemberNotFound
+	current := h.load()
+	next := &ringSnapshot{
+		hashfn:       current.hashfn,
+		nodes:        copyNodes(current.nodes, len(current.nodes)+len(members)),
+		virtualNodes: make([]virtualNode, 0, len(current.virtualNodes)+len(members)*int(h.replicationFactor)),
+		draining:     current.draining,
+		aliases:      current.aliases,
 	}
+	next.virtualNodes = append(next.virtualNodes, current.virtualNodes...)
 
-	indexesToRemove := make([]int, 0, h.replicationFactor)
-	for _, vnode := range foundNode.virtualNodes {
-		vnode := vnode
-		vnodeIndex := sort.Search(len(h.virtualNodes), func(i int) bool {
-			return cmpVnode(h.virtualNodes[i], vnode) >= 0
-		})
-		if vnodeIndex >= len(h.virtualNodes) {
-			return fmt.Errorf(
-				"failed to delete vnode %020d/%020d/%s: %w",
-				vnode.hashvalue,
-				vnode.members.hashvalue,
-				vnode.members.nodeKey,
-				ErrVnodeNotFound,
-			)
+	// addOrder records the position of each new member in members, so that
+	// collisions can be counted the same way as if they were added one by one.
+	addOrder := make(map[*nodeRecord]int, len(members))
+	virtualNodeBuffer := make([]byte, virtualNodeBufferSize)
+	for i, member := range members {
+		if member.Key() == "" {
+			return ErrEmptyMemberKey
 		}
 
-		indexesToRemove = append(indexesToRemove, vnodeIndex)
-	}
+		nodeID := memberID(member)
+		if _, ok := next.nodes[nodeID]; ok {
+			return ErrMemberAlreadyExists
+		}
 
-	sort.Slice(indexesToRemove, func(i, j int) bool {
-		// NOTE: this is a reverse sort!
-		return indexesToRemove[j] < indexesToRemove[i]
-	})
+		newNodeRecord := h.newNodeRecord(current.hashfn, member, 1, virtualNodeBuffer)
+		addOrder[newNodeRecord] = i
 
-	if len(indexesToRemove) != int(h.replicationFactor) {
-		return ErrUnexpectedVnodeCount
+		next.nodes[nodeID] = newNodeRecord
+		next.virtualNodes = append(next.virtualNodes, newNodeRecord.virtualNodes...)
 	}
 
-	for i, indexToRemove := range indexesToRemove {
-		// Swap this index for a later one
-		h.virtualNodes[indexToRemove] = h.virtualNodes[len(h.virtualNodes)-1-i]
-	}
+	slices.SortFunc(next.virtualNodes, h.cmpVnode)
+	h.collisions += countBulkCollisions(next.virtualNodes, addOrder)
 
-	// Truncate and sort the nodelist
-	h.virtualNodes = h.virtualNodes[:len(h.virtualNodes)-len(indexesToRemove)]
-	slices.SortFunc(h.virtualNodes, cmpVnode)
+	h.snapshot.Store(next)
 
-	// Remove the node from our map
-	delete(h.nodes, nodeKeyString)
+	if h.observer != nil {
+		for _, member := range members {
+			h.observer.OnAdd(memberID(member))
+		}
+	}
 
 	return nil
 }
 
-// FindN finds the first N members after the specified key.
+// ReplaceAll atomically replaces every member of the hashring with members,
+// such as to apply a full refresh of a member list without computing the
+// difference. Readers observe either the old members or the new ones, never a
+// mix of the two.
 //
-// If there are not enough members to satisfy the request, ErrNotEnoughMembers
-// is returned.
-func (h *Ring) FindN(key []byte, num uint8) ([]Member, error) {
-	h.RLock()
-	defer h.RUnlock()
+// A member that's a WeightedMember has the weight it reports. Otherwise, a
+// member with the same ID as one already in the hashring keeps that member's
+// weight, and any other member has a weight of 1. Members that remain in the
+// hashring stay draining if they were. Observers are notified of the members
+// that were added and removed. Aliases added by AddAlias whose targets remain
+// resolve to the new members, and the rest are removed along with their
+// targets or replaced by a member with the same key.
+//
+// If several members have the same ID, a member's weight is invalid, or a
+// member's key is empty, an error joining ErrMemberAlreadyExists,
+// ErrInvalidWeight, or ErrEmptyMemberKey for each such member is returned and
+// the hashring is left unchanged.
+func (h *Ring) ReplaceAll(members []Member) error {
+	h.Lock()
+	defer h.Unlock()
 
-	if int(num) > len(h.nodes) {
-		return nil, ErrNotEnoughMembers
+	current := h.load()
+	weights := make([]uint16, len(members))
+	seen := make(map[string]struct{}, len(members))
+	totalWeight := 0
+	var errs []error
+	for i, member := range members {
+		if member.Key() == "" {
+			errs = append(errs, fmt.Errorf("member %d: %w", i, ErrEmptyMemberKey))
+			continue
+		}
+
+		nodeID := memberID(member)
+		if _, ok := seen[nodeID]; ok {
+			errs = append(errs, fmt.Errorf("%q: %w", nodeID, ErrMemberAlreadyExists))
+			continue
+		}
+		seen[nodeID] = struct{}{}
+
+		weights[i] = 1
+		if weighted, ok := member.(WeightedMember); ok {
+			weights[i] = weighted.Weight()
+		} else if record, ok := current.member(nodeID); ok {
+			weights[i] = record.weight
+		}
+
+		if !validWeight(h.replicationFactor, weights[i]) {
+			errs = append(errs, fmt.Errorf("%q: %w", nodeID, ErrInvalidWeight))
+			continue
+		}
+		totalWeight += int(weights[i])
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
 	}
 
-	keyHash := h.hashfn(key)
+	next := &ringSnapshot{
+		hashfn:       current.hashfn,
+		nodes:        make(map[string]*nodeRecord, len(members)),
+		virtualNodes: make([]virtualNode, 0, totalWeight*int(h.replicationFactor)),
+	}
 
-	vnodeIndex := sort.Search(len(h.virtualNodes), func(i int) bool {
-		return h.virtualNodes[i].hashvalue >= keyHash
-	})
+	// Members that weren't already in the hashring are counted as though
+	// they were added in order.
+	addOrder := make(map[*nodeRecord]int, len(members))
+	virtualNodeBuffer := make([]byte, virtualNodeBufferSize)
+	for i, member := range members {
+		nodeID := memberID(member)
+		newNodeRecord := h.newNodeRecord(current.hashfn, member, weights[i], virtualNodeBuffer)
+		if _, ok := current.member(nodeID); !ok {
+			addOrder[newNodeRecord] = i
+		}
 
-	alreadyFoundNodeKeys := map[string]struct{}{}
-	foundNodes := make([]Member, 0, num)
-	for i := 0; i < len(h.virtualNodes) && len(foundNodes) < int(num); i++ {
-		boundedIndex := (i + vnodeIndex) % len(h.virtualNodes)
-		candidate := h.virtualNodes[boundedIndex]
-		if _, ok := alreadyFoundNodeKeys[candidate.members.nodeKey]; !ok {
-			foundNodes = append(foundNodes, candidate.members.member)
-			alreadyFoundNodeKeys[candidate.members.nodeKey] = struct{}{}
+		next.nodes[nodeID] = newNodeRecord
+		next.virtualNodes = append(next.virtualNodes, newNodeRecord.virtualNodes...)
+
+		if _, ok := current.draining[nodeID]; ok {
+			if next.draining == nil {
+				next.draining = make(map[string]struct{}, len(current.draining))
+			}
+			next.draining[nodeID] = struct{}{}
 		}
 	}
 
-	return foundNodes, nil
-}
+	// Aliases whose targets remain now resolve to the new members, while
+	// those whose targets were removed are removed along with them, as are
+	// any whose keys are taken by a new member.
+	for aliasID, record := range current.nodes {
+		if record.target == nil {
+			continue
+		}
+		target, ok := next.nodes[record.targetID]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[aliasID]; ok {
+			continue
+		}
 
-// Members enumerates the full set of hashring members.
-func (h *Ring) Members() []Member {
-	h.RLock()
-	defer h.RUnlock()
+		newNodeRecord := h.newNodeRecord(current.hashfn, alias{key: record.nodeKey, target: target.member}, record.weight, virtualNodeBuffer)
+		next.nodes[aliasID] = newNodeRecord
+		next.virtualNodes = append(next.virtualNodes, newNodeRecord.virtualNodes...)
+		next.aliases++
+	}
+
+	slices.SortFunc(next.virtualNodes, h.cmpVnode)
+	h.collisions += countBulkCollisions(next.virtualNodes, addOrder)
 
-	membersCopy := make([]Member, 0, len(h.nodes))
-	for _, nodeInfo := range h.nodes {
-		membersCopy = append(membersCopy, nodeInfo.member)
+	h.snapshot.Store(next)
+
+	if h.observer != nil {
+		removed := make([]string, 0, current.size())
+		for nodeID, record := range current.nodes {
+			if _, ok := next.member(nodeID); !ok && record.target == nil {
+				removed = append(removed, nodeID)
+			}
+		}
+		sort.Strings(removed)
+		for _, nodeID := range removed {
+			h.observer.OnRemove(nodeID)
+		}
+		for _, member := range members {
+			if _, ok := current.member(memberID(member)); !ok {
+				h.observer.OnAdd(memberID(member))
+			}
+		}
 	}
-	return membersCopy
-}
 
-type nodeRecord struct {
-	hashvalue    uint64
-	nodeKey      string
-	member       Member
-	virtualNodes []virtualNode
+	return nil
 }
 
-type virtualNode struct {
-	hashvalue uint64
-	members   nodeRecord
+// SetReplicationFactor changes the number of virtual nodes per member,
+// rebuilding the virtual nodes of every existing member.
+//
+// If the provided replication factor is less than 1,
+// ErrInvalidReplicationFactor is returned. If it's greater than the maximum
+// set with NewWithMaxReplicationFactor, ErrReplicationFactorTooLarge is
+// returned.
+func (h *Ring) SetReplicationFactor(replicationFactor uint16) error {
+	if replicationFactor < 1 {
+		return ErrInvalidReplicationFactor
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.replicationFactorTooLarge(uint32(replicationFactor)) {
+		return ErrReplicationFactorTooLarge
+	}
+
+	current := h.load()
+	totalWeight := 0
+	for _, record := range current.nodes {
+		if !validWeight(replicationFactor, record.weight) {
+			return ErrInvalidWeight
+		}
+		totalWeight += int(record.weight)
+	}
+
+	h.replicationFactor = replicationFactor
+	h.snapshot.Store(h.rebuild(current, current.hashfn, totalWeight))
+
+	return nil
 }
 
-// compareUint64 should be replaced with the standard library's cmp.Compare once
-// Go 1.21 is released.
-func compareUint64(x, y uint64) int {
-	if x < y {
-		return -1
+// IncreaseReplicationFactor adds delta virtual nodes per unit of weight to
+// every member, without moving any of the existing virtual nodes.
+//
+// Virtual nodes are placed by the hash of their member and their offset, so
+// a member's first n virtual nodes are the same at any replication factor,
+// and the result is the same as SetReplicationFactor with the sum. Unlike
+// SetReplicationFactor, only the new virtual nodes are hashed, and since none
+// of the existing ones move, the only keys remapped are those that the new
+// virtual nodes take over from other members: roughly delta/(factor+delta) of
+// them, rather than nearly every key as with Rehash. Doubling the factor still
+// remaps about half of the keys.
+//
+// Decreasing isn't symmetric, so there's no counterpart to this method:
+// SetReplicationFactor with a smaller factor drops every member's highest
+// offsets, which only restores the placement from before an increase if the
+// members and their weights haven't changed since, and it rehashes every
+// remaining virtual node to do so.
+//
+// If the resulting replication factor is greater than math.MaxUint16 or the
+// maximum set with NewWithMaxReplicationFactor, ErrReplicationFactorTooLarge
+// is returned, and if it leaves a member with too many virtual nodes for its
+// weight, ErrInvalidWeight is returned.
+func (h *Ring) IncreaseReplicationFactor(delta uint16) error {
+	if delta == 0 {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.replicationFactorTooLarge(uint32(h.replicationFactor) + uint32(delta)) {
+		return ErrReplicationFactorTooLarge
+	}
+	replicationFactor := h.replicationFactor + delta
+
+	current := h.load()
+	totalVnodes := 0
+	for _, record := range current.nodes {
+		if !validWeight(replicationFactor, record.weight) {
+			return ErrInvalidWeight
+		}
+		totalVnodes += int(vnodeCount(replicationFactor, record.weight))
+	}
+
+	// Every member gets a new record, so the existing vnodes are copied to
+	// point at it rather than at the record readers of the current snapshot
+	// may still be using.
+	next := &ringSnapshot{
+		hashfn:   current.hashfn,
+		nodes:    make(map[string]*nodeRecord, len(current.nodes)),
+		draining: current.draining,
+		aliases:  current.aliases,
+	}
+	records := make(map[*nodeRecord]*nodeRecord, len(current.nodes))
+	added := make([]virtualNode, 0, totalVnodes-len(current.virtualNodes))
+	virtualNodeBuffer := make([]byte, virtualNodeBufferSize)
+	for nodeID, record := range current.nodes {
+		numVnodes := vnodeCount(replicationFactor, record.weight)
+		newNodeRecord := &nodeRecord{
+			record.hashvalue,
+			record.nodeKey,
+			record.nodeID,
+			record.member,
+			record.weight,
+			make([]virtualNode, 0, numVnodes),
+			record.target,
+			record.targetID,
+		}
+		for _, vnode := range record.virtualNodes {
+			newNodeRecord.virtualNodes = append(newNodeRecord.virtualNodes, virtualNode{vnode.hashvalue, newNodeRecord})
+		}
+
+		for i := uint16(len(record.virtualNodes)); i < numVnodes; i++ {
+			vnode := virtualNode{h.vnodeHash(current.hashfn, record.hashvalue, record.nodeKey, i, virtualNodeBuffer), newNodeRecord}
+			newNodeRecord.virtualNodes = append(newNodeRecord.virtualNodes, vnode)
+			added = append(added, vnode)
+		}
+		slices.SortFunc(newNodeRecord.virtualNodes, h.cmpVnode)
+
+		records[record] = newNodeRecord
+		next.nodes[nodeID] = newNodeRecord
+	}
+
+	existing := make([]virtualNode, 0, len(current.virtualNodes))
+	for _, vnode := range current.virtualNodes {
+		existing = append(existing, virtualNode{vnode.hashvalue, records[vnode.node]})
 	}
-	if x > y {
-		return +1
+
+	slices.SortFunc(added, h.cmpVnode)
+	h.collisions += countCollisions(existing, added)
+	next.virtualNodes = mergeVnodes(existing, added, h.cmpVnode)
+
+	h.replicationFactor = replicationFactor
+	h.snapshot.Store(next)
+
+	return nil
+}
+
+// Rehash changes the hash function of the hashring, rebuilding the virtual
+// nodes of every existing member, such as to replace a hash function that
+// distributes keys poorly.
+//
+// Membership, weights, and draining members are preserved, but this is a
+// disruptive operation: nearly every key is assigned to a different member
+// afterwards, so any state keyed by member, such as caches, is effectively
+// invalidated. Collisions under the new hash function are added to
+// CollisionCount.
+func (h *Ring) Rehash(hashfn HashFunc) error {
+	h.Lock()
+	defer h.Unlock()
+
+	current := h.load()
+	totalWeight := 0
+	for _, record := range current.nodes {
+		totalWeight += int(record.weight)
+	}
+
+	next := h.rebuild(current, hashfn, totalWeight)
+
+	// Every member is effectively re-added, so collisions are counted as
+	// though they were added in order of ID.
+	nodeIDs := make([]string, 0, len(next.nodes))
+	for nodeID := range next.nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	addOrder := make(map[*nodeRecord]int, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		addOrder[next.nodes[nodeID]] = i
+	}
+	h.collisions += countBulkCollisions(next.virtualNodes, addOrder)
+
+	h.snapshot.Store(next)
+
+	return nil
+}
+
+// rebuild returns a snapshot with the members of current, with virtual nodes
+// recomputed using hashfn and the ring's replication factor. totalWeight is
+// the sum of the members' weights.
+//
+// The caller must hold the write lock.
+func (h *Ring) rebuild(current *ringSnapshot, hashfn HashFunc, totalWeight int) *ringSnapshot {
+	next := &ringSnapshot{
+		hashfn:       hashfn,
+		nodes:        make(map[string]*nodeRecord, len(current.nodes)),
+		virtualNodes: make([]virtualNode, 0, totalWeight*int(h.replicationFactor)),
+		draining:     current.draining,
+		aliases:      current.aliases,
+	}
+
+	virtualNodeBuffer := make([]byte, virtualNodeBufferSize)
+	for nodeID, record := range current.nodes {
+		newNodeRecord := h.newNodeRecord(hashfn, record.member, record.weight, virtualNodeBuffer)
+		next.nodes[nodeID] = newNodeRecord
+		next.virtualNodes = append(next.virtualNodes, newNodeRecord.virtualNodes...)
+	}
+
+	slices.SortFunc(next.virtualNodes, h.cmpVnode)
+
+	return next
+}
+
+// Verify checks the invariants of the hashring's internal state: that its
+// virtual nodes are sorted, that every member has as many virtual nodes as its
+// weight calls for, and that every virtual node belongs to a member.
+//
+// It returns nil if the hashring is consistent, and otherwise an error
+// describing the first problem found, which wraps ErrVnodesUnsorted,
+// ErrUnexpectedVnodeCount, ErrVnodeNotFound, or ErrMemberNotFound. Rebuild
+// repairs an inconsistent hashring.
+func (h *Ring) Verify() error {
+	h.RLock()
+	defer h.RUnlock()
+
+	current := h.load()
+	virtualNodes := current.virtualNodes
+
+	inRing := make(map[virtualNode]int, len(virtualNodes))
+	for i, vnode := range virtualNodes {
+		if i > 0 && h.cmpVnode(virtualNodes[i-1], vnode) > 0 {
+			return fmt.Errorf("vnode %d of %d: %w", i, len(virtualNodes), ErrVnodesUnsorted)
+		}
+		if record, ok := current.nodes[vnode.node.nodeID]; !ok || record != vnode.node {
+			return fmt.Errorf("vnode %020d belongs to %q: %w", vnode.hashvalue, vnode.node.nodeID, ErrMemberNotFound)
+		}
+		inRing[vnode]++
+	}
+
+	nodeIDs := make([]string, 0, len(current.nodes))
+	for nodeID := range current.nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+
+	for _, nodeID := range nodeIDs {
+		record := current.nodes[nodeID]
+		if expected := int(vnodeCount(h.replicationFactor, record.weight)); len(record.virtualNodes) != expected {
+			return fmt.Errorf("%q has %d vnodes rather than %d: %w", nodeID, len(record.virtualNodes), expected, ErrUnexpectedVnodeCount)
+		}
+
+		for _, vnode := range record.virtualNodes {
+			if inRing[vnode] == 0 {
+				return fmt.Errorf("vnode %020d of %q: %w", vnode.hashvalue, nodeID, ErrVnodeNotFound)
+			}
+			inRing[vnode]--
+		}
+	}
+
+	// Every vnode belongs to a member, and every member's vnodes have been
+	// accounted for, so any left over are duplicates.
+	for vnode, count := range inRing {
+		if count > 0 {
+			return fmt.Errorf("%q has %d extra vnodes: %w", vnode.node.nodeID, count, ErrUnexpectedVnodeCount)
+		}
+	}
+
+	for nodeID := range current.draining {
+		if _, ok := current.member(nodeID); !ok {
+			return fmt.Errorf("draining %q: %w", nodeID, ErrMemberNotFound)
+		}
+	}
+
+	return nil
+}
+
+// Rebuild repairs a hashring whose internal state is inconsistent, as
+// reported by Verify, by recomputing every member's virtual nodes from its
+// member and weight. Members that are draining stay draining.
+//
+// A consistent hashring is left as it was, though it's still rebuilt, so
+// Rebuild is as expensive as SetReplicationFactor.
+func (h *Ring) Rebuild() {
+	h.Lock()
+	defer h.Unlock()
+
+	current := h.load()
+	totalWeight := 0
+	for _, record := range current.nodes {
+		totalWeight += int(record.weight)
+	}
+
+	next := h.rebuild(current, current.hashfn, totalWeight)
+	next.draining = nil
+	for nodeID := range current.draining {
+		if _, ok := current.member(nodeID); ok {
+			if next.draining == nil {
+				next.draining = make(map[string]struct{}, len(current.draining))
+			}
+			next.draining[nodeID] = struct{}{}
+		}
+	}
+
+	h.snapshot.Store(next)
+}
+
+// SetWeight changes the weight of the member with the specified key,
+// rebuilding its virtual nodes.
+//
+// If no member can be found, ErrMemberNotFound is returned. If the weight is
+// invalid, ErrInvalidWeight is returned.
+func (h *Ring) SetWeight(nodeID string, weight uint16) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if !validWeight(h.replicationFactor, weight) {
+		return ErrInvalidWeight
+	}
+
+	current := h.load()
+	foundNode, ok := current.member(nodeID)
+	if !ok {
+		return ErrMemberNotFound
+	}
+
+	if foundNode.weight == weight {
+		return nil
+	}
+
+	newNodeRecord := h.newNodeRecord(current.hashfn, foundNode.member, weight, make([]byte, virtualNodeBufferSize))
+
+	// Drop the member's old vnodes and merge in the new ones.
+	remaining := make([]virtualNode, 0, len(current.virtualNodes)-len(foundNode.virtualNodes))
+	for _, vnode := range current.virtualNodes {
+		if vnode.node != foundNode {
+			remaining = append(remaining, vnode)
+		}
+	}
+
+	next := &ringSnapshot{
+		hashfn:       current.hashfn,
+		nodes:        copyNodes(current.nodes, len(current.nodes)),
+		virtualNodes: mergeVnodes(remaining, newNodeRecord.virtualNodes, h.cmpVnode),
+		draining:     current.draining,
+		aliases:      current.aliases,
+	}
+	next.nodes[nodeID] = newNodeRecord
+
+	h.snapshot.Store(next)
+
+	return nil
+}
+
+// newNodeRecord allocates a nodeRecord for member along with its sorted
+// virtual nodes, hashed with hashfn, using virtualNodeBuffer as scratch space.
+//
+// The caller must hold the write lock and have checked the weight with
+// validWeight.
+func (h *Ring) newNodeRecord(hashfn HashFunc, member Member, weight uint16, virtualNodeBuffer []byte) *nodeRecord {
+	nodeKeyString := member.Key()
+	nodeHash := hashfn([]byte(nodeKeyString))
+	numVnodes := vnodeCount(h.replicationFactor, weight)
+	newNodeRecord := &nodeRecord{
+		nodeHash,
+		nodeKeyString,
+		memberID(member),
+		member,
+		weight,
+		make([]virtualNode, 0, numVnodes),
+		nil,
+		"",
+	}
+	if alias, ok := member.(alias); ok {
+		newNodeRecord.target = alias.target
+		newNodeRecord.targetID = memberID(alias.target)
+	}
+
+	for i := uint16(0); i < numVnodes; i++ {
+		virtualNode := virtualNode{
+			h.vnodeHash(hashfn, nodeHash, nodeKeyString, i, virtualNodeBuffer),
+			newNodeRecord,
+		}
+
+		newNodeRecord.virtualNodes = append(newNodeRecord.virtualNodes, virtualNode)
+	}
+
+	slices.SortFunc(newNodeRecord.virtualNodes, h.cmpVnode)
+
+	return newNodeRecord
+}
+
+// vnodeHash returns the hash of the virtual node at index replica of the
+// member with the given key and key hash, using virtualNodeBuffer as scratch
+// space.
+func (h *Ring) vnodeHash(hashfn HashFunc, nodeHash uint64, nodeKey string, replica uint16, virtualNodeBuffer []byte) uint64 {
+	if h.vnodeHasher != nil {
+		return h.vnodeHasher(hashfn, nodeHash, nodeKey, replica)
+	}
+
+	// virtualNodeBuffer is a 10-byte array, where 8 bytes are the hash value of
+	// the member key, and the final 2 bytes are an offset of the virtual node
+	// itself. This value is then hashed to get the final hash value of the virtual node.
+	binary.LittleEndian.PutUint64(virtualNodeBuffer, nodeHash)
+	binary.LittleEndian.PutUint16(virtualNodeBuffer[8:], replica)
+	return hashfn(virtualNodeBuffer)
+}
+
+// RemoveIfPresent removes the specified member from the hashring if it's a
+// member, reporting whether it was, so that reconciling membership with an
+// external source doesn't have to treat ErrMemberNotFound specially.
+//
+// The only errors returned are those that indicate the hashring's internal
+// state is inconsistent, ErrVnodeNotFound and ErrUnexpectedVnodeCount.
+func (h *Ring) RemoveIfPresent(member Member) (bool, error) {
+	err := h.RemoveByKey(memberID(member))
+	if errors.Is(err, ErrMemberNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Remove finds and removes the specified member from the hashring.
+//
+// If no member can be found, ErrMemberNotFound is returned.
+func (h *Ring) Remove(member Member) error {
+	return h.RemoveByKey(memberID(member))
+}
+
+// RemoveByKey finds and removes the member or alias with the specified key
+// from the hashring. Removing a member also removes every alias that resolves
+// to it.
+//
+// If no member can be found, ErrMemberNotFound is returned.
+func (h *Ring) RemoveByKey(nodeID string) error {
+	h.Lock()
+	defer h.Unlock()
+
+	current := h.load()
+	foundNode, ok := current.nodes[nodeID]
+	if !ok {
+		return ErrMemberNotFound
+	}
+
+	// Aliases of the member would otherwise keep resolving keys to it.
+	var aliases []*nodeRecord
+	if foundNode.target == nil && current.aliases > 0 {
+		for _, record := range current.nodes {
+			if record.target != nil && record.targetID == nodeID {
+				aliases = append(aliases, record)
+			}
+		}
+	}
+
+	// The member's vnodes are sorted the same way as the ring, so a single
+	// pass over the ring finds every one of them in order, without searching
+	// for each or comparing anything but their hashes, and copying
+	// every other vnode keeps the ring sorted.
+	toRemove := foundNode.virtualNodes
+	virtualNodes := make([]virtualNode, 0, max(len(current.virtualNodes)-len(toRemove), 0))
+	for _, vnode := range current.virtualNodes {
+		if len(toRemove) > 0 && vnode.node == foundNode && vnode.hashvalue == toRemove[0].hashvalue {
+			toRemove = toRemove[1:]
+			continue
+		}
+		if len(aliases) > 0 && vnode.node.target != nil && vnode.node.targetID == nodeID {
+			continue
+		}
+		virtualNodes = append(virtualNodes, vnode)
+	}
+	if len(toRemove) > 0 {
+		vnode := toRemove[0]
+		return fmt.Errorf(
+			"failed to delete vnode %020d/%020d/%s: %w",
+			vnode.hashvalue,
+			vnode.node.hashvalue,
+			vnode.node.nodeKey,
+			ErrVnodeNotFound,
+		)
+	}
+
+	if len(foundNode.virtualNodes) != int(vnodeCount(h.replicationFactor, foundNode.weight)) {
+		return ErrUnexpectedVnodeCount
+	}
+
+	next := &ringSnapshot{
+		hashfn:       current.hashfn,
+		nodes:        copyNodes(current.nodes, len(current.nodes)),
+		virtualNodes: virtualNodes,
+		draining:     current.draining,
+		aliases:      current.aliases - len(aliases),
+	}
+
+	// Remove the node from our map
+	delete(next.nodes, nodeID)
+	for _, record := range aliases {
+		delete(next.nodes, record.nodeID)
+	}
+	if foundNode.target != nil {
+		next.aliases--
+	}
+
+	if _, ok := current.draining[nodeID]; ok {
+		next.draining = copyDraining(current.draining)
+		delete(next.draining, nodeID)
+	}
+
+	h.snapshot.Store(next)
+
+	if h.observer != nil && foundNode.target == nil {
+		h.observer.OnRemove(nodeID)
+	}
+
+	return nil
+}
+
+// Clear removes every member from the hashring at once, without the
+// consistency checks of Remove, such as to reset a hashring during teardown.
+// The replication factor, hash function, and collision count are kept.
+// Observers are notified of every member that was removed.
+func (h *Ring) Clear() {
+	h.Lock()
+	defer h.Unlock()
+
+	current := h.load()
+	h.snapshot.Store(&ringSnapshot{
+		hashfn: current.hashfn,
+		nodes:  map[string]*nodeRecord{},
+	})
+
+	if h.observer != nil {
+		removed := make([]string, 0, current.size())
+		for nodeID, record := range current.nodes {
+			if record.target == nil {
+				removed = append(removed, nodeID)
+			}
+		}
+		sort.Strings(removed)
+		for _, nodeID := range removed {
+			h.observer.OnRemove(nodeID)
+		}
+	}
+}
+
+// Find finds the first member after the specified key.
+//
+// It is equivalent to FindN with a num of 1, but avoids allocating.
+//
+// A nil or empty key is valid and is hashed like any other, so it
+// deterministically resolves to the same member as every other empty key.
+//
+// If the hashring is empty, ErrNotEnoughMembers is returned.
+func (h *Ring) Find(key []byte) (Member, error) {
+	snapshot := h.load()
+	return snapshot.find(snapshot.hashfn(key))
+}
+
+// FindUint64 finds the first member after the specified integer key.
+//
+// The key is hashed from its 8-byte little-endian encoding rather than from a
+// string, so it's placed differently than the same number passed to Find as
+// a formatted string. Callers must use one encoding consistently.
+//
+// If the hashring is empty, ErrNotEnoughMembers is returned.
+func (h *Ring) FindUint64(key uint64) (Member, error) {
+	snapshot := h.load()
+	return snapshot.find(snapshot.hashUint64(key))
+}
+
+// find finds the first member after the specified key hash.
+func (s *ringSnapshot) find(keyHash uint64) (Member, error) {
+	vnodeIndex, ok := s.ownerIndex(keyHash)
+	if !ok {
+		return nil, ErrNotEnoughMembers
+	}
+
+	return s.virtualNodes[vnodeIndex].node.resolved(), nil
+}
+
+// ownerIndex returns the index of the vnode that owns keyHash: the first vnode
+// at or after it that doesn't belong to a draining member. It returns false if
+// there's no such vnode.
+func (s *ringSnapshot) ownerIndex(keyHash uint64) (int, bool) {
+	virtualNodes := s.virtualNodes
+	if s.size() == len(s.draining) {
+		return 0, false
+	}
+
+	vnodeIndex := sort.Search(len(virtualNodes), func(i int) bool {
+		return virtualNodes[i].hashvalue >= keyHash
+	}) % len(virtualNodes)
+
+	if len(s.draining) > 0 {
+		for {
+			if _, ok := s.draining[virtualNodes[vnodeIndex].node.resolvedID()]; !ok {
+				break
+			}
+			vnodeIndex = (vnodeIndex + 1) % len(virtualNodes)
+		}
+	}
+
+	return vnodeIndex, true
+}
+
+// FindVnode finds the virtual node that the specified key resolves to,
+// returning the key of the member that owns it along with the virtual node's
+// hash and its index in the ring. The ID is returned instead of the key for an
+// IdentifiedMember.
+//
+// It's meant for explaining why a key was assigned to a particular member; the
+// returned member key always matches the member returned by Find.
+//
+// If the hashring is empty, ErrNotEnoughMembers is returned.
+func (h *Ring) FindVnode(key []byte) (memberKey string, vnodeHash uint64, vnodeIndex int, err error) {
+	snapshot := h.load()
+
+	vnodeIndex, ok := snapshot.ownerIndex(snapshot.hashfn(key))
+	if !ok {
+		return "", 0, 0, ErrNotEnoughMembers
+	}
+
+	vnode := snapshot.virtualNodes[vnodeIndex]
+	return vnode.node.resolvedID(), vnode.hashvalue, vnodeIndex, nil
+}
+
+// FindN finds the first N members after the specified key.
+//
+// Members are returned in the order they're first reached walking the
+// hashring from the key. The order depends only on the members, their
+// weights, and the hashring's configuration, never on the order in which
+// members were added, so identical hashrings always agree on it, and callers
+// can treat the first member as the primary owner of the key and the rest as
+// its secondaries.
+//
+// Like Find, a nil or empty key is valid and deterministic.
+//
+// If there are not enough members to satisfy the request, ErrNotEnoughMembers
+// is returned.
+func (h *Ring) FindN(key []byte, num uint8) ([]Member, error) {
+	return h.FindNExcluding(key, num, nil)
+}
+
+// FindNExcluding finds the first N members after the specified key, skipping
+// any members whose keys are in exclude.
+//
+// Excluded members are treated as though they were not in the hashring, so if
+// there are not enough remaining members to satisfy the request,
+// ErrNotEnoughMembers is returned. Draining members are always skipped, so
+// excluding one has no further effect.
+func (h *Ring) FindNExcluding(key []byte, num uint8, exclude map[string]struct{}) ([]Member, error) {
+	snapshot := h.load()
+	return snapshot.findN(context.Background(), snapshot.hashfn(key), num, exclude)
+}
+
+// FindNContext finds the first N members after the specified key, like FindN,
+// but periodically checks ctx while walking the hashring and returns ctx's
+// error if it's done.
+//
+// It's meant for very large rings where a large num can require walking many
+// virtual nodes; FindN remains faster for the common case.
+func (h *Ring) FindNContext(ctx context.Context, key []byte, num uint8) ([]Member, error) {
+	snapshot := h.load()
+	return snapshot.findN(ctx, snapshot.hashfn(key), num, nil)
+}
+
+// FindNUint64 finds the first N members after the specified integer key.
+//
+// Like FindUint64, the key is hashed from its 8-byte little-endian encoding,
+// so it's placed differently than the same number formatted as a string.
+//
+// If there are not enough members to satisfy the request, ErrNotEnoughMembers
+// is returned.
+func (h *Ring) FindNUint64(key uint64, num uint8) ([]Member, error) {
+	snapshot := h.load()
+	return snapshot.findN(context.Background(), snapshot.hashUint64(key), num, nil)
+}
+
+// FindNHashed finds the first N members after the specified key hash, like
+// FindN but without hashing the key, so that a key can be hashed once and
+// looked up in several rings.
+//
+// The caller must hash the key with the same hash function as the ring;
+// nothing can detect a mismatch, and a hash from a different function places
+// the key arbitrarily.
+//
+// If there are not enough members to satisfy the request, ErrNotEnoughMembers
+// is returned.
+func (h *Ring) FindNHashed(keyHash uint64, num uint8) ([]Member, error) {
+	return h.load().findN(context.Background(), keyHash, num, nil)
+}
+
+// IsOwner reports whether the member identified by self is among the first
+// spread members for key, as FindN would return them, such as for a process
+// that is itself a member to decide whether to handle a key.
+//
+// self is the member's ID if it's an IdentifiedMember and its key otherwise.
+// Members that aren't in the hashring or are draining own no keys. Unlike
+// FindN, IsOwner doesn't allocate, and it stops walking the hashring as soon
+// as the answer is known.
+//
+// If there are fewer than spread members, ErrNotEnoughMembers is returned.
+func (h *Ring) IsOwner(key []byte, self string, spread uint8) (bool, error) {
+	snapshot := h.load()
+	if int(spread) > snapshot.size()-len(snapshot.draining) {
+		return false, ErrNotEnoughMembers
+	}
+
+	if _, ok := snapshot.member(self); !ok || spread == 0 {
+		return false, nil
+	}
+	if _, ok := snapshot.draining[self]; ok {
+		return false, nil
+	}
+
+	keyHash := snapshot.hashfn(key)
+	virtualNodes := snapshot.virtualNodes
+	vnodeIndex := sort.Search(len(virtualNodes), func(i int) bool {
+		return virtualNodes[i].hashvalue >= keyHash
+	})
+
+	// The same walk as walkN, except that it only keeps track of the members
+	// it has passed.
+	var passedBuffer [16]*nodeRecord
+	passed := passedBuffer[:0]
+	for i := 0; i < len(virtualNodes) && len(passed) < int(spread); i++ {
+		if vnodeIndex == len(virtualNodes) {
+			vnodeIndex = 0
+		}
+		candidate := virtualNodes[vnodeIndex]
+		vnodeIndex++
+
+		if spread > 1 && containsResolved(passed, candidate.node) {
+			continue
+		}
+		if _, ok := snapshot.draining[candidate.node.resolvedID()]; ok {
+			continue
+		}
+
+		if candidate.node.resolvedID() == self {
+			return true, nil
+		}
+		passed = append(passed, candidate.node)
+	}
+
+	return false, nil
+}
+
+// FindNWithSelf finds the first N members after the specified key, like
+// FindN, along with the rank of the member identified by self among them: its
+// index in members, or -1 if it isn't one of them. It's meant for a process
+// that is itself a member to decide in one call whether to handle a key
+// locally, and as which replica, or which member to forward it to.
+//
+// self is the member's ID if it's an IdentifiedMember and its key otherwise,
+// as for IsOwner.
+//
+// If there are not enough members to satisfy the request, ErrNotEnoughMembers
+// is returned.
+func (h *Ring) FindNWithSelf(key []byte, num uint8, self string) (members []Member, selfRank int, err error) {
+	snapshot := h.load()
+	members, err = snapshot.findN(context.Background(), snapshot.hashfn(key), num, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	for i, member := range members {
+		if memberID(member) == self {
+			return members, i, nil
+		}
+	}
+
+	return members, -1, nil
+}
+
+// hashUint64 hashes the 8-byte little-endian encoding of key, the same way
+// vnode hashes are computed from a binary buffer.
+func (s *ringSnapshot) hashUint64(key uint64) uint64 {
+	var keyBuffer [8]byte
+	binary.LittleEndian.PutUint64(keyBuffer[:], key)
+	return s.hashfn(keyBuffer[:])
+}
+
+// findNCheckInterval is the number of vnodes walked by findN between checks of
+// its context.
+const findNCheckInterval = 1024
+
+// findN finds the first N members after the specified key hash, skipping any
+// members whose keys are in exclude.
+//
+// The context is only checked if it can be cancelled.
+func (s *ringSnapshot) findN(ctx context.Context, keyHash uint64, num uint8, exclude map[string]struct{}) ([]Member, error) {
+	return walkN(ctx, s, keyHash, num, exclude, func(vnode virtualNode) Member {
+		return vnode.node.resolved()
+	})
+}
+
+// FindNAcrossZones finds N members for the specified key like FindN, but
+// prefers members in distinct zones, such as to place replicas in different
+// availability zones. Walking the hashring from the key, a member is skipped
+// if a member already found is in the same zone.
+//
+// Members that aren't ZonedMembers are each treated as being in a zone of
+// their own. If the walk runs out of members before finding N in distinct
+// zones, such as when there are fewer than N zones, the skipped members fill
+// the remainder in the order they were walked, so the result is only short if
+// FindN's would be. The first member is always the one Find returns.
+//
+// If there are not enough members to satisfy the request, ErrNotEnoughMembers
+// is returned.
+func (h *Ring) FindNAcrossZones(key []byte, num uint8) ([]Member, error) {
+	snapshot := h.load()
+	virtualNodes := snapshot.virtualNodes
+
+	available := snapshot.size() - len(snapshot.draining)
+	if int(num) > available {
+		return nil, ErrNotEnoughMembers
+	}
+
+	keyHash := snapshot.hashfn(key)
+	vnodeIndex := sort.Search(len(virtualNodes), func(i int) bool {
+		return virtualNodes[i].hashvalue >= keyHash
+	})
+
+	walked := make(map[string]struct{}, num)
+	zones := make(map[string]struct{}, num)
+	foundNodes := make([]Member, 0, num)
+	var skipped []Member
+	for i := 0; i < len(virtualNodes) && len(foundNodes) < int(num) && len(walked) < available; i++ {
+		candidate := virtualNodes[(i+vnodeIndex)%len(virtualNodes)]
+		if _, ok := snapshot.draining[candidate.node.resolvedID()]; ok {
+			continue
+		}
+		if _, ok := walked[candidate.node.resolvedID()]; ok {
+			continue
+		}
+		walked[candidate.node.resolvedID()] = struct{}{}
+
+		member := candidate.node.resolved()
+		if zoned, ok := member.(ZonedMember); ok {
+			zone := zoned.Zone()
+			if _, ok := zones[zone]; ok {
+				skipped = append(skipped, member)
+				continue
+			}
+			zones[zone] = struct{}{}
+		}
+
+		foundNodes = append(foundNodes, member)
+	}
+
+	for _, member := range skipped {
+		if len(foundNodes) == int(num) {
+			break
+		}
+		foundNodes = append(foundNodes, member)
+	}
+
+	return foundNodes, nil
+}
+
+// MemberDistance is a member found by FindNWithDistance along with its
+// distance from the key.
+type MemberDistance struct {
+	Member Member
+
+	// Distance is the forward arc from the key's hash to the first virtual
+	// node owned by Member, wrapping around the end of the hash space.
+	Distance uint64
+}
+
+// FindNWithDistance finds the first N members after the specified key, like
+// FindN, along with how far along the hashring each member's first virtual
+// node is from the key. Distances are non-decreasing, so callers can use them
+// to weigh how close a replica is rather than just its rank.
+//
+// If there are not enough members to satisfy the request, ErrNotEnoughMembers
+// is returned.
+func (h *Ring) FindNWithDistance(key []byte, num uint8) ([]MemberDistance, error) {
+	snapshot := h.load()
+	keyHash := snapshot.hashfn(key)
+	return walkN(context.Background(), snapshot, keyHash, num, nil, func(vnode virtualNode) MemberDistance {
+		return MemberDistance{Member: vnode.node.resolved(), Distance: vnode.hashvalue - keyHash}
+	})
+}
+
+// walkN walks snapshot from keyHash and returns the result of found for the
+// first virtual node of each of the first N distinct members, skipping any
+// members whose keys are in exclude.
+func walkN[T any](ctx context.Context, snapshot *ringSnapshot, keyHash uint64, num uint8, exclude map[string]struct{}, found func(virtualNode) T) ([]T, error) {
+	done := ctx.Done()
+
+	virtualNodes := snapshot.virtualNodes
+
+	available := snapshot.size() - len(snapshot.draining)
+	for excludedKey := range exclude {
+		if _, ok := snapshot.member(excludedKey); !ok {
+			continue
+		}
+		if _, ok := snapshot.draining[excludedKey]; !ok {
+			available--
+		}
+	}
+
+	if int(num) > available {
+		return nil, ErrNotEnoughMembers
+	}
+
+	vnodeIndex := sort.Search(len(virtualNodes), func(i int) bool {
+		return virtualNodes[i].hashvalue >= keyHash
+	})
+
+	// num is small, so scanning the members found so far is cheaper than
+	// tracking them in a map, and the scan is skipped entirely when only one
+	// member is needed. It comes before the exclusion checks since it doesn't
+	// need to dereference the candidate, and those checks are skipped when
+	// there's nothing to exclude.
+	skipExcluded := len(exclude) > 0 || len(snapshot.draining) > 0
+	var foundNodeRecordsBuffer [16]*nodeRecord
+	foundNodeRecords := foundNodeRecordsBuffer[:0]
+	foundNodes := make([]T, 0, num)
+	boundedIndex := vnodeIndex
+	for i := 0; i < len(virtualNodes) && len(foundNodes) < int(num); i++ {
+		if done != nil && i%findNCheckInterval == findNCheckInterval-1 {
+			select {
+			case <-done:
+				return nil, ctx.Err()
+			default:
+			}
+		}
+
+		if boundedIndex == len(virtualNodes) {
+			boundedIndex = 0
+		}
+		candidate := virtualNodes[boundedIndex]
+		boundedIndex++
+
+		if num > 1 && containsResolved(foundNodeRecords, candidate.node) {
+			continue
+		}
+		if skipExcluded {
+			if _, ok := exclude[candidate.node.resolvedID()]; ok {
+				continue
+			}
+			if _, ok := snapshot.draining[candidate.node.resolvedID()]; ok {
+				continue
+			}
+		}
+
+		foundNodes = append(foundNodes, found(candidate))
+		foundNodeRecords = append(foundNodeRecords, candidate.node)
+	}
+
+	return foundNodes, nil
+}
+
+// LoadDistribution returns the fraction of the hash space owned by each
+// member, keyed by member key.
+//
+// The fractions are computed from the gaps between virtual nodes rather than
+// by hashing sample keys. A well-tuned ring will show fractions near
+// 1/len(members); raising the replication factor brings them closer.
+func (h *Ring) LoadDistribution() map[string]float64 {
+	virtualNodes := h.load().virtualNodes
+
+	distribution := make(map[string]float64)
+	if len(virtualNodes) == 0 {
+		return distribution
+	}
+
+	if len(virtualNodes) == 1 {
+		distribution[virtualNodes[0].node.nodeID] = 1
+		return distribution
+	}
+
+	// Each vnode owns the keys hashing after the previous vnode, up to and
+	// including its own hash; the first vnode owns the wrap-around arc, which
+	// unsigned subtraction handles for free.
+	for i, vnode := range virtualNodes {
+		previous := virtualNodes[(i+len(virtualNodes)-1)%len(virtualNodes)]
+		arc := vnode.hashvalue - previous.hashvalue
+		distribution[vnode.node.nodeID] += float64(arc) / math.Exp2(64)
+	}
+
+	return distribution
+}
+
+// VnodeGaps returns the length of the arc of the hash space owned by each of
+// the virtual nodes of the member with the specified key, in hashring order,
+// such as to spot a member whose vnodes were placed unusually close together
+// or far apart. The gaps sum to the member's share of LoadDistribution times
+// 2^64.
+//
+// A vnode owns the keys hashing after the previous vnode up to its own hash,
+// so a vnode whose hash collides with the previous one owns nothing. The lone
+// vnode of a hashring with only one owns the entire hash space, which is
+// reported as math.MaxUint64.
+//
+// If no member can be found, ErrMemberNotFound is returned.
+func (h *Ring) VnodeGaps(key string) ([]uint64, error) {
+	snapshot := h.load()
+	virtualNodes := snapshot.virtualNodes
+
+	record, ok := snapshot.nodes[key]
+	if !ok {
+		return nil, ErrMemberNotFound
+	}
+
+	if len(virtualNodes) == 1 {
+		return []uint64{math.MaxUint64}, nil
+	}
+
+	gaps := make([]uint64, 0, len(record.virtualNodes))
+	for i, vnode := range virtualNodes {
+		if vnode.node != record {
+			continue
+		}
+
+		previous := virtualNodes[(i+len(virtualNodes)-1)%len(virtualNodes)]
+		gaps = append(gaps, vnode.hashvalue-previous.hashvalue)
+	}
+
+	return gaps, nil
+}
+
+// EstimateRemap returns the fraction of the sample keys whose owner, as found by
+// Find, differs between before and this ring, such as to estimate how many
+// cache entries a membership change invalidated. Clone can be used to keep a
+// copy of the ring from before a change.
+//
+// Owners are compared by ID. A key counts as remapped if it has an owner in
+// only one of the rings. If keys is empty, 0 is returned.
+func (h *Ring) EstimateRemap(keys [][]byte, before *Ring) float64 {
+	if len(keys) == 0 {
+		return 0
+	}
+
+	afterSnapshot, beforeSnapshot := h.load(), before.load()
+
+	remapped := 0
+	for _, key := range keys {
+		if ownerID(afterSnapshot, afterSnapshot.hashfn(key)) != ownerID(beforeSnapshot, beforeSnapshot.hashfn(key)) {
+			remapped++
+		}
+	}
+
+	return float64(remapped) / float64(len(keys))
+}
+
+// Plan is the effect a membership change would have on a Ring, as previewed
+// by PlanAdd or PlanRemove.
+type Plan struct {
+	// Remapped is the fraction of the hash space whose owner would change,
+	// which estimates the fraction of keys that would move to a different
+	// member.
+	Remapped float64
+
+	// Delta is the change in each member's share of the hash space, as
+	// reported by LoadDistribution, keyed by member ID. Members being added
+	// gain their entire share and members being removed lose theirs.
+	Delta map[string]float64
+}
+
+// PlanAdd previews the effect of adding members to the hashring, such as to
+// check how many keys a scale-up would move before applying it. The members
+// are added to a Clone as AddMany would add them, so the hashring itself is
+// unchanged.
+//
+// Any error AddMany would return is returned.
+func (h *Ring) PlanAdd(members []Member) (Plan, error) {
+	planned := h.Clone()
+	if err := planned.AddMany(members); err != nil {
+		return Plan{}, err
+	}
+
+	return planned.planFrom(h), nil
+}
+
+// PlanRemove previews the effect of removing members from the hashring, like
+// PlanAdd. The members are removed from a Clone, so the hashring itself is
+// unchanged.
+//
+// Any error Remove would return for one of the members is returned.
+func (h *Ring) PlanRemove(members []Member) (Plan, error) {
+	planned := h.Clone()
+	for _, member := range members {
+		if err := planned.Remove(member); err != nil {
+			return Plan{}, fmt.Errorf("%q: %w", memberID(member), err)
+		}
+	}
+
+	return planned.planFrom(h), nil
+}
+
+// planFrom returns the Plan that changes before into h.
+func (h *Ring) planFrom(before *Ring) Plan {
+	plan := Plan{Delta: h.LoadDistribution()}
+	for nodeID, share := range before.LoadDistribution() {
+		plan.Delta[nodeID] -= share
+	}
+
+	beforeSnapshot, afterSnapshot := before.load(), h.load()
+
+	// Every key between two adjacent vnode hashes of either ring has the same
+	// owner as the later hash, so comparing owners at those hashes covers the
+	// entire hash space.
+	hashes := make([]uint64, 0, len(beforeSnapshot.virtualNodes)+len(afterSnapshot.virtualNodes))
+	for _, vnode := range beforeSnapshot.virtualNodes {
+		hashes = append(hashes, vnode.hashvalue)
+	}
+	for _, vnode := range afterSnapshot.virtualNodes {
+		hashes = append(hashes, vnode.hashvalue)
+	}
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+
+	for i, hash := range hashes {
+		if ownerID(beforeSnapshot, hash) == ownerID(afterSnapshot, hash) {
+			continue
+		}
+		if len(hashes) == 1 {
+			plan.Remapped = 1
+			break
+		}
+		previous := hashes[(i+len(hashes)-1)%len(hashes)]
+		plan.Remapped += float64(hash-previous) / math.Exp2(64)
+	}
+
+	return plan
+}
+
+// ownerID returns the ID of the member of the snapshot that owns keyHash, or
+// an empty string if there's none.
+func ownerID(snapshot *ringSnapshot, keyHash uint64) string {
+	vnodeIndex, ok := snapshot.ownerIndex(keyHash)
+	if !ok {
+		return ""
+	}
+	return snapshot.virtualNodes[vnodeIndex].node.resolvedID()
+}
+
+// Range is an interval of the hash space owned by a single virtual node. It
+// excludes Start and includes End, matching how Find assigns keys to the
+// first virtual node at or after their hash.
+//
+// Ranges wrap around the end of the hash space: if End is less than Start,
+// the range covers every hash after Start along with every hash up to End. If
+// End equals Start, the range covers the entire hash space.
+type Range struct {
+	Start, End uint64
+}
+
+// MemberRanges returns the ranges of the hash space owned by the virtual nodes
+// of the member with the specified key, ordered by End.
+//
+// If no member can be found, ErrMemberNotFound is returned.
+func (h *Ring) MemberRanges(key string) ([]Range, error) {
+	snapshot := h.load()
+	virtualNodes := snapshot.virtualNodes
+
+	record, ok := snapshot.nodes[key]
+	if !ok {
+		return nil, ErrMemberNotFound
+	}
+
+	ranges := make([]Range, 0, len(record.virtualNodes))
+	for _, vnode := range record.virtualNodes {
+		// When vnodes collide, the first of them owns every key that hashes
+		// to them, just as in Find.
+		vnodeIndex := sort.Search(len(virtualNodes), func(i int) bool {
+			return virtualNodes[i].hashvalue >= vnode.hashvalue
+		})
+		if virtualNodes[vnodeIndex].node != record {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1].End == vnode.hashvalue {
+			continue
+		}
+
+		previous := virtualNodes[(vnodeIndex+len(virtualNodes)-1)%len(virtualNodes)]
+		ranges = append(ranges, Range{Start: previous.hashvalue, End: vnode.hashvalue})
+	}
+
+	return ranges, nil
+}
+
+// Contains reports whether a member with the same key is in the hashring.
+func (h *Ring) Contains(member Member) bool {
+	_, ok := h.load().member(memberID(member))
+	return ok
+}
+
+// Weight returns the weight of the member with the specified key.
+//
+// If no member can be found, ErrMemberNotFound is returned.
+func (h *Ring) Weight(key string) (uint16, error) {
+	record, ok := h.load().member(key)
+	if !ok {
+		return 0, ErrMemberNotFound
+	}
+
+	return record.weight, nil
+}
+
+// CollisionCount returns the number of virtual nodes that have hashed to the
+// same value as a virtual node of a different member when added to the
+// hashring.
+//
+// Collisions don't affect correctness, since ties are broken consistently, but
+// a member whose vnodes collide owns less of the hash space than it should. A
+// growing count suggests trying a different hash function. The count is
+// cumulative and isn't decreased when members are removed.
+func (h *Ring) CollisionCount() int {
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.collisions
+}
+
+// Drain stops assigning keys to the member with the specified key while keeping
+// it in the hashring, so that it can finish its in-flight work before being
+// removed.
+//
+// A draining member is skipped by Find and FindN, as though it were excluded,
+// and its keys go to the next members along the hashring. It's still reported
+// by Members, Size, and LoadDistribution, and its virtual nodes stay in place,
+// so Undrain restores its keys immediately. Draining a member that's already
+// draining has no effect.
+//
+// If no member can be found, ErrMemberNotFound is returned.
+func (h *Ring) Drain(nodeID string) error {
+	return h.setDraining(nodeID, true)
+}
+
+// Undrain resumes assigning keys to a member that was drained with Drain.
+// Undraining a member that isn't draining has no effect.
+//
+// If no member can be found, ErrMemberNotFound is returned.
+func (h *Ring) Undrain(nodeID string) error {
+	return h.setDraining(nodeID, false)
+}
+
+func (h *Ring) setDraining(nodeID string, draining bool) error {
+	h.Lock()
+	defer h.Unlock()
+
+	current := h.load()
+	if _, ok := current.member(nodeID); !ok {
+		return ErrMemberNotFound
+	}
+
+	if _, ok := current.draining[nodeID]; ok == draining {
+		return nil
+	}
+
+	next := &ringSnapshot{
+		hashfn:       current.hashfn,
+		nodes:        current.nodes,
+		virtualNodes: current.virtualNodes,
+		draining:     copyDraining(current.draining),
+		aliases:      current.aliases,
+	}
+
+	if draining {
+		next.draining[nodeID] = struct{}{}
+	} else {
+		delete(next.draining, nodeID)
+	}
+
+	h.snapshot.Store(next)
+
+	return nil
+}
+
+// IsDraining reports whether the member with the specified key is draining.
+func (h *Ring) IsDraining(nodeID string) bool {
+	_, ok := h.load().draining[nodeID]
+	return ok
+}
+
+// Size returns the number of members in the hashring.
+//
+// Unlike len(Members()), it doesn't allocate.
+func (h *Ring) Size() int {
+	return h.load().size()
+}
+
+// ReplicationFactor returns the number of virtual nodes per unit of weight
+// given to each member, as set by New or SetReplicationFactor.
+//
+// There's no equivalent accessor for the hash function, since functions can't
+// be compared in Go. Code that needs to identify or serialize a ring's hash
+// function should track an opaque name for it alongside the ring, such as the
+// name it's registered under with the consistent package's RegisterHashFunc.
+func (h *Ring) ReplicationFactor() uint16 {
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.replicationFactor
+}
+
+// VnodeCount returns the number of virtual nodes in the hashring.
+func (h *Ring) VnodeCount() int {
+	return len(h.load().virtualNodes)
+}
+
+// WalkVnodes calls fn with the hash and member key of every virtual node in
+// the order they appear in the hashring, stopping early if fn returns false,
+// such as to visualize how the hash space is divided between members.
+//
+// The walk covers a snapshot of the hashring taken when it starts, so fn may
+// modify the hashring without affecting it.
+func (h *Ring) WalkVnodes(fn func(hash uint64, memberKey string) bool) {
+	for _, vnode := range h.load().virtualNodes {
+		if !fn(vnode.hashvalue, vnode.node.nodeKey) {
+			return
+		}
+	}
+}
+
+// Members enumerates the full set of hashring members.
+func (h *Ring) Members() []Member {
+	snapshot := h.load()
+
+	membersCopy := make([]Member, 0, snapshot.size())
+	for _, nodeInfo := range snapshot.nodes {
+		if nodeInfo.target == nil {
+			membersCopy = append(membersCopy, nodeInfo.member)
+		}
+	}
+	return membersCopy
+}
+
+type nodeRecord struct {
+	hashvalue    uint64
+	nodeKey      string
+	nodeID       string
+	member       Member
+	weight       uint16
+	virtualNodes []virtualNode
+	target       Member // the member an alias resolves to; nil if it isn't an alias
+	targetID     string
+}
+
+// resolved returns the member that keys owned by the record resolve to.
+func (n *nodeRecord) resolved() Member {
+	if n.target != nil {
+		return n.target
+	}
+	return n.member
+}
+
+// resolvedID returns the ID of the member that keys owned by the record
+// resolve to.
+func (n *nodeRecord) resolvedID() string {
+	if n.target != nil {
+		return n.targetID
+	}
+	return n.nodeID
+}
+
+// containsResolved reports whether any of records resolves to the same member
+// as record, which is only possible for distinct records if one is an alias.
+func containsResolved(records []*nodeRecord, record *nodeRecord) bool {
+	for _, found := range records {
+		if found == record {
+			return true
+		}
+		if (found.target != nil || record.target != nil) && found.resolvedID() == record.resolvedID() {
+			return true
+		}
+	}
+	return false
+}
+
+// virtualNodeBufferSize is the size of the buffer hashed to place a virtual
+// node: the 8-byte hash of the member key followed by the 2-byte vnode index.
+const virtualNodeBufferSize = 10
+
+// validWeight reports whether a member with the given weight can be added to a
+// ring with the given replication factor.
+//
+// Vnodes are numbered with a uint16, which limits how many a member can have.
+func validWeight(replicationFactor, weight uint16) bool {
+	return weight > 0 && uint32(replicationFactor)*uint32(weight) <= math.MaxUint16
+}
+
+// vnodeCount returns the number of vnodes of a member with the given weight.
+func vnodeCount(replicationFactor, weight uint16) uint16 {
+	return replicationFactor * weight
+}
+
+// virtualNode is kept as small as possible, since a ring holds
+// replicationFactor of them for every member.
+type virtualNode struct {
+	hashvalue uint64
+	node      *nodeRecord
+}
+
+// mergeVnodes merges the vnodes in toAdd and the vnodes in existing, both
+// sorted by cmp, into a newly allocated sorted slice.
+//
+// Neither input is modified, so existing may still be in use by readers.
+func mergeVnodes(existing, toAdd []virtualNode, cmp func(a, b virtualNode) int) []virtualNode {
+	merged := make([]virtualNode, 0, len(existing)+len(toAdd))
+
+	i, j := 0, 0
+	for i < len(existing) && j < len(toAdd) {
+		if cmp(existing[i], toAdd[j]) > 0 {
+			merged = append(merged, toAdd[j])
+			j++
+		} else {
+			merged = append(merged, existing[i])
+			i++
+		}
+	}
+	merged = append(merged, existing[i:]...)
+	merged = append(merged, toAdd[j:]...)
+
+	return merged
+}
+
+// countCollisions returns the number of vnodes in the sorted toAdd with the
+// same hash as a vnode in the sorted existing.
+func countCollisions(existing, toAdd []virtualNode) int {
+	collisions := 0
+	for _, vnode := range toAdd {
+		vnodeIndex := sort.Search(len(existing), func(i int) bool {
+			return existing[i].hashvalue >= vnode.hashvalue
+		})
+		if vnodeIndex < len(existing) && existing[vnodeIndex].hashvalue == vnode.hashvalue {
+			collisions++
+		}
+	}
+	return collisions
+}
+
+// countBulkCollisions returns the number of new vnodes in the sorted vnodes with
+// the same hash as a vnode added before them, where addOrder holds the order
+// in which the new members were added. Members missing from addOrder were
+// already in the ring.
+func countBulkCollisions(vnodes []virtualNode, addOrder map[*nodeRecord]int) int {
+	collisions := 0
+	for start := 0; start < len(vnodes); {
+		end := start + 1
+		for end < len(vnodes) && vnodes[end].hashvalue == vnodes[start].hashvalue {
+			end++
+		}
+
+		if end-start > 1 {
+			// The first member added with this hash doesn't collide.
+			first := math.MaxInt
+			for _, vnode := range vnodes[start:end] {
+				order, ok := addOrder[vnode.node]
+				if !ok {
+					order = -1
+				}
+				if order < first {
+					first = order
+				}
+			}
+
+			for _, vnode := range vnodes[start:end] {
+				if order, ok := addOrder[vnode.node]; ok && order != first {
+					collisions++
+				}
+			}
+		}
+
+		start = end
+	}
+	return collisions
+}
+
+// copyDraining returns a copy of draining with room for one more entry.
+func copyDraining(draining map[string]struct{}) map[string]struct{} {
+	copied := make(map[string]struct{}, len(draining)+1)
+	for k := range draining {
+		copied[k] = struct{}{}
+	}
+	return copied
+}
+
+// copyNodes returns a copy of nodes with capacity for at least size entries.
+func copyNodes(nodes map[string]*nodeRecord, size int) map[string]*nodeRecord {
+	copied := make(map[string]*nodeRecord, size)
+	for k, v := range nodes {
+		copied[k] = v
+	}
+	return copied
+}
+
+// cmpVnode orders vnodes in the ring, first consulting the ring's Comparator
+// for vnodes of different members with the same hash.
+func (h *Ring) cmpVnode(a, b virtualNode) int {
+	if h.tieBreak != nil && a.hashvalue == b.hashvalue && a.node != b.node {
+		if c := h.tieBreak(a.node.member, b.node.member); c != 0 {
+			return c
+		}
 	}
-	return 0
+	return cmpVnode(a, b)
 }
 
+// cmpVnode orders vnodes by hash, breaking ties by member hash, key, and then
+// ID.
 func cmpVnode(a, b virtualNode) int {
 	if a.hashvalue == b.hashvalue {
-		if a.members.hashvalue == b.members.hashvalue {
-			return strings.Compare(a.members.nodeKey, b.members.nodeKey)
+		if a.node.hashvalue == b.node.hashvalue {
+			if c := strings.Compare(a.node.nodeKey, b.node.nodeKey); c != 0 {
+				return c
+			}
+			return strings.Compare(a.node.nodeID, b.node.nodeID)
 		}
-		return compareUint64(a.members.hashvalue, b.members.hashvalue)
+		return cmp.Compare(a.node.hashvalue, b.node.hashvalue)
 	}
-	return compareUint64(a.hashvalue, b.hashvalue)
+	return cmp.Compare(a.hashvalue, b.hashvalue)
 }
@@ -0,0 +1,156 @@
+package hashring
+
+import "sync"
+
+// JumpHash maps a key to one of numBuckets buckets using the jump consistent
+// hash algorithm described by Lamping and Veach in "A Fast, Minimal Memory,
+// Consistent Hash Algorithm".
+//
+// When numBuckets grows from n to n+1, only 1/(n+1) of keys move, and they all
+// move to the new bucket. If numBuckets is less than 1, 0 is returned.
+func JumpHash(key uint64, numBuckets int) int32 {
+	if numBuckets < 1 {
+		return 0
+	}
+
+	var b int64 = -1
+	var j int64
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int32(b)
+}
+
+// JumpRing provides a thread-safe Hasher backed by jump consistent hashing.
+//
+// Members are identified by their position in an ordered list, making this
+// suitable for backends with stable ordinals (such as the pods of a
+// StatefulSet) where the set only grows or shrinks from the end. It has
+// perfect balance and no per-member memory overhead, but only the last member
+// can be removed.
+type JumpRing struct {
+	hashfn HashFunc
+
+	sync.RWMutex
+	members []Member
+	keys    map[string]struct{}
+}
+
+var _ Hasher = (*JumpRing)(nil)
+
+// NewJumpRing allocates a JumpRing with the specified hash function and
+// initial ordered members.
+//
+// If any members share a key, ErrMemberAlreadyExists is returned.
+func NewJumpRing(hashfn HashFunc, members []Member) (*JumpRing, error) {
+	r := &JumpRing{
+		hashfn: hashfn,
+		keys:   make(map[string]struct{}, len(members)),
+	}
+
+	for _, member := range members {
+		if err := r.Add(member); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Add appends a member to the end of the ordered members.
+//
+// If a member with the same key has already been added,
+// ErrMemberAlreadyExists is returned.
+func (r *JumpRing) Add(member Member) error {
+	memberKey := member.Key()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.keys[memberKey]; ok {
+		return ErrMemberAlreadyExists
+	}
+
+	r.members = append(r.members, member)
+	r.keys[memberKey] = struct{}{}
+
+	return nil
+}
+
+// Remove removes the specified member, which must be the last of the ordered
+// members.
+//
+// If no member can be found, ErrMemberNotFound is returned. If the member is
+// not the last member, ErrNotLastMember is returned.
+func (r *JumpRing) Remove(member Member) error {
+	memberKey := member.Key()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.keys[memberKey]; !ok {
+		return ErrMemberNotFound
+	}
+
+	if r.members[len(r.members)-1].Key() != memberKey {
+		return ErrNotLastMember
+	}
+
+	r.members = r.members[:len(r.members)-1]
+	delete(r.keys, memberKey)
+
+	return nil
+}
+
+// Find finds the member whose bucket the specified key is mapped to.
+//
+// If there are no members, ErrNotEnoughMembers is returned.
+func (r *JumpRing) Find(key []byte) (Member, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.members) == 0 {
+		return nil, ErrNotEnoughMembers
+	}
+
+	return r.members[JumpHash(r.hashfn(key), len(r.members))], nil
+}
+
+// FindN finds the member whose bucket the specified key is mapped to, followed
+// by the N-1 members after it in order, wrapping around to the first member.
+//
+// If there are not enough members to satisfy the request, ErrNotEnoughMembers
+// is returned.
+func (r *JumpRing) FindN(key []byte, num uint8) ([]Member, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if int(num) > len(r.members) {
+		return nil, ErrNotEnoughMembers
+	}
+
+	found := make([]Member, 0, num)
+	if num == 0 {
+		return found, nil
+	}
+
+	bucket := int(JumpHash(r.hashfn(key), len(r.members)))
+	for i := 0; i < int(num); i++ {
+		found = append(found, r.members[(bucket+i)%len(r.members)])
+	}
+
+	return found, nil
+}
+
+// Members enumerates the full set of members, in order.
+func (r *JumpRing) Members() []Member {
+	r.RLock()
+	defer r.RUnlock()
+
+	membersCopy := make([]Member, len(r.members))
+	copy(membersCopy, r.members)
+	return membersCopy
+}
@@ -0,0 +1,118 @@
+package hashring
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJumpHash(t *testing.T) {
+	// Test vectors shared by the reference implementations of jump hash.
+	testCases := []struct {
+		key        uint64
+		numBuckets int
+		expected   int32
+	}{
+		{1, 1, 0},
+		{42, 57, 43},
+		{0xDEAD10CC, 1, 0},
+		{0xDEAD10CC, 666, 361},
+		{256, 1024, 520},
+		{0, -10, 0},
+		{0xDEAD10CC, -666, 0},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, JumpHash(tc.key, tc.numBuckets), "JumpHash(%d, %d)", tc.key, tc.numBuckets)
+	}
+}
+
+func TestJumpHashGrowth(t *testing.T) {
+	for key := uint64(0); key < 10_000; key++ {
+		previous := JumpHash(key, 1)
+		for numBuckets := 2; numBuckets <= 50; numBuckets++ {
+			// A key either stays put or moves to the newly added bucket.
+			bucket := JumpHash(key, numBuckets)
+			if bucket != previous {
+				require.Equal(t, int32(numBuckets-1), bucket)
+			}
+			previous = bucket
+		}
+	}
+}
+
+func TestJumpRing(t *testing.T) {
+	_, err := NewJumpRing(xxhash.Sum64, []Member{member(0), member(0)})
+	require.Equal(t, ErrMemberAlreadyExists, err)
+
+	r, err := NewJumpRing(xxhash.Sum64, nil)
+	require.NoError(t, err)
+
+	_, err = r.Find([]byte("key1"))
+	require.Equal(t, ErrNotEnoughMembers, err)
+
+	for memberNum := 0; memberNum < 3; memberNum++ {
+		require.NoError(t, r.Add(member(memberNum)))
+	}
+	require.Equal(t, ErrMemberAlreadyExists, r.Add(member(1)))
+	require.Equal(t, []Member{member(0), member(1), member(2)}, r.Members())
+
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+
+		all, err := r.FindN(key, 3)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []Member{member(0), member(1), member(2)}, all)
+
+		single, err := r.Find(key)
+		require.NoError(t, err)
+		require.Equal(t, all[0], single)
+	}
+
+	_, err = r.FindN([]byte("key1"), 4)
+	require.Equal(t, ErrNotEnoughMembers, err)
+
+	require.Equal(t, ErrNotLastMember, r.Remove(member(0)))
+	require.Equal(t, ErrMemberNotFound, r.Remove(member(5)))
+	require.NoError(t, r.Remove(member(2)))
+	require.Equal(t, []Member{member(0), member(1)}, r.Members())
+}
+
+func TestJumpRingBalance(t *testing.T) {
+	for _, numMembers := range []int{1, 2, 3, 5, 10, 100} {
+		numMembers := numMembers
+		t.Run(strconv.Itoa(numMembers), func(t *testing.T) {
+			t.Parallel()
+
+			members := make([]Member, 0, numMembers)
+			for memberNum := 0; memberNum < numMembers; memberNum++ {
+				members = append(members, member(memberNum))
+			}
+
+			r, err := NewJumpRing(xxhash.Sum64, members)
+			require.NoError(t, err)
+
+			memberKeyCount := map[member]int{}
+			for i := 0; i < numTestKeys; i++ {
+				found, err := r.Find([]byte(strconv.Itoa(i)))
+				require.NoError(t, err)
+				memberKeyCount[found.(member)]++
+			}
+			require.Len(t, memberKeyCount, numMembers)
+
+			mean := float64(numTestKeys) / float64(numMembers)
+			stddevSum := 0.0
+			for _, count := range memberKeyCount {
+				stddevSum += math.Pow(float64(count)-mean, 2)
+			}
+			stddev := math.Sqrt(stddevSum / float64(numMembers))
+
+			// Jump hash balances as well as a uniform random assignment, so the
+			// deviation is on the order of sqrt(mean).
+			require.Less(t, stddev, 3*math.Sqrt(mean))
+		})
+	}
+}
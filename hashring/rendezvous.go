@@ -0,0 +1,136 @@
+package hashring
+
+import (
+	"sort"
+	"sync"
+)
+
+// Rendezvous provides a thread-safe implementation of rendezvous hashing, also
+// known as highest random weight (HRW) hashing.
+//
+// Every member is scored for each key by hashing the key together with the
+// member's key, and the highest scoring members own the key. This requires no
+// virtual nodes, so it uses less memory than a Ring and distributes keys
+// evenly, but finding the owners of a key is linear in the number of members.
+// It is best suited to small member sets.
+type Rendezvous struct {
+	hashfn HashFunc
+
+	sync.RWMutex
+	members map[string]Member
+}
+
+var _ Hasher = (*Rendezvous)(nil)
+
+// NewRendezvous allocates a Rendezvous with the specified hash function.
+func NewRendezvous(hashfn HashFunc) *Rendezvous {
+	return &Rendezvous{
+		hashfn:  hashfn,
+		members: map[string]Member{},
+	}
+}
+
+// Add inserts a member.
+//
+// If a member with the same key has already been added,
+// ErrMemberAlreadyExists is returned.
+func (r *Rendezvous) Add(member Member) error {
+	memberKey := member.Key()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.members[memberKey]; ok {
+		return ErrMemberAlreadyExists
+	}
+
+	r.members[memberKey] = member
+
+	return nil
+}
+
+// Remove finds and removes the specified member.
+//
+// If no member can be found, ErrMemberNotFound is returned.
+func (r *Rendezvous) Remove(member Member) error {
+	memberKey := member.Key()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.members[memberKey]; !ok {
+		return ErrMemberNotFound
+	}
+
+	delete(r.members, memberKey)
+
+	return nil
+}
+
+// Find finds the highest scoring member for the specified key.
+//
+// If there are no members, ErrNotEnoughMembers is returned.
+func (r *Rendezvous) Find(key []byte) (Member, error) {
+	found, err := r.FindN(key, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return found[0], nil
+}
+
+// FindN finds the N highest scoring members for the specified key, in
+// descending order of score.
+//
+// If there are not enough members to satisfy the request, ErrNotEnoughMembers
+// is returned.
+func (r *Rendezvous) FindN(key []byte, num uint8) ([]Member, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if int(num) > len(r.members) {
+		return nil, ErrNotEnoughMembers
+	}
+
+	type scoredMember struct {
+		score  uint64
+		key    string
+		member Member
+	}
+
+	// buf holds the request key followed by the member key being scored.
+	buf := make([]byte, len(key), len(key)+64)
+	copy(buf, key)
+
+	scored := make([]scoredMember, 0, len(r.members))
+	for memberKey, member := range r.members {
+		buf = append(buf[:len(key)], memberKey...)
+		scored = append(scored, scoredMember{r.hashfn(buf), memberKey, member})
+	}
+
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].score == scored[j].score {
+			return scored[i].key < scored[j].key
+		}
+		return scored[i].score > scored[j].score
+	})
+
+	found := make([]Member, 0, num)
+	for _, candidate := range scored[:num] {
+		found = append(found, candidate.member)
+	}
+
+	return found, nil
+}
+
+// Members enumerates the full set of members.
+func (r *Rendezvous) Members() []Member {
+	r.RLock()
+	defer r.RUnlock()
+
+	membersCopy := make([]Member, 0, len(r.members))
+	for _, member := range r.members {
+		membersCopy = append(membersCopy, member)
+	}
+	return membersCopy
+}
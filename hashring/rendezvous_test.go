@@ -0,0 +1,102 @@
+package hashring
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRendezvous(t *testing.T) {
+	r := NewRendezvous(xxhash.Sum64)
+
+	_, err := r.Find([]byte("key1"))
+	require.Equal(t, ErrNotEnoughMembers, err)
+
+	found, err := r.FindN([]byte("key1"), 0)
+	require.NoError(t, err)
+	require.Empty(t, found)
+
+	for memberNum := 0; memberNum < 3; memberNum++ {
+		require.NoError(t, r.Add(member(memberNum)))
+	}
+	require.Equal(t, ErrMemberAlreadyExists, r.Add(member(0)))
+	require.Len(t, r.Members(), 3)
+
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+
+		all, err := r.FindN(key, 3)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []Member{member(0), member(1), member(2)}, all)
+
+		single, err := r.Find(key)
+		require.NoError(t, err)
+		require.Equal(t, all[0], single)
+
+		// A rendezvous built in a different order must agree.
+		reverse := NewRendezvous(xxhash.Sum64)
+		for memberNum := 2; memberNum >= 0; memberNum-- {
+			require.NoError(t, reverse.Add(member(memberNum)))
+		}
+		reverseAll, err := reverse.FindN(key, 3)
+		require.NoError(t, err)
+		require.Equal(t, all, reverseAll)
+	}
+
+	_, err = r.FindN([]byte("key1"), 4)
+	require.Equal(t, ErrNotEnoughMembers, err)
+
+	require.NoError(t, r.Remove(member(1)))
+	require.Equal(t, ErrMemberNotFound, r.Remove(member(1)))
+	require.ElementsMatch(t, []Member{member(0), member(2)}, r.Members())
+}
+
+func TestRendezvousBalance(t *testing.T) {
+	for _, numMembers := range []int{2, 3, 5} {
+		numMembers := numMembers
+		t.Run(strconv.Itoa(numMembers), func(t *testing.T) {
+			t.Parallel()
+
+			r := NewRendezvous(xxhash.Sum64)
+			memberKeyCount := map[member]int{}
+			for memberNum := 0; memberNum < numMembers; memberNum++ {
+				require.NoError(t, r.Add(member(memberNum)))
+				memberKeyCount[member(memberNum)] = 0
+			}
+
+			const numKeys = 100_000
+			for i := 0; i < numKeys; i++ {
+				found, err := r.Find([]byte(strconv.Itoa(i)))
+				require.NoError(t, err)
+				memberKeyCount[found.(member)]++
+			}
+
+			mean := float64(numKeys) / float64(numMembers)
+			stddevSum := 0.0
+			for _, count := range memberKeyCount {
+				stddevSum += math.Pow(float64(count)-mean, 2)
+			}
+			stddev := math.Sqrt(stddevSum / float64(numMembers))
+
+			require.Less(t, stddev, mean*.01)
+		})
+	}
+}
+
+func TestRendezvousConsistency(t *testing.T) {
+	r := NewRendezvous(xxhash.Sum64)
+
+	for memberNum := 0; memberNum < 5; memberNum++ {
+		require.NoError(t, r.Add(member(memberNum)))
+	}
+
+	spread := uint8(3)
+	numTestKeys := 1000
+	for i := 0; i < 10; i++ {
+		before, perturbation, affectedMember := perturb(t, r, spread, numTestKeys)
+		verify(t, r, before, perturbation, affectedMember, spread, numTestKeys)
+	}
+}
@@ -0,0 +1,142 @@
+package consistent
+
+// BuilderOption customizes a Builder created by NewBuilder.
+type BuilderOption func(*builder)
+
+// WithKeyFunc sets the KeyFunc used to extract the value to hash from each
+// request.
+//
+// Defaults to ContextKeyFunc.
+func WithKeyFunc(keyFn KeyFunc) BuilderOption {
+	return func(b *builder) {
+		b.keyFn = keyFn
+	}
+}
+
+// WithMetadataKeys hashes each request on the values of the given outgoing
+// gRPC metadata headers joined with sep, as though WithKeyFunc were given
+// CompositeMetadataKeyFunc(sep, headers...).
+func WithMetadataKeys(sep string, headers ...string) BuilderOption {
+	return WithKeyFunc(CompositeMetadataKeyFunc(sep, headers...))
+}
+
+// WithMemberKeyFunc sets the MemberKeyFunc used to derive the hashring key of
+// each resolved address, such as to identify backends by a node ID that a
+// custom resolver stores in the address's attributes rather than by their
+// network address.
+//
+// Addresses with the same key are treated as the same backend, so the keys of
+// distinct backends must differ.
+//
+// Defaults to DefaultMemberKey.
+func WithMemberKeyFunc(keyFn MemberKeyFunc) BuilderOption {
+	return func(b *builder) {
+		b.memberKeyFn = keyFn
+	}
+}
+
+// WithHealthCheck enables client-side health checking for every balancer
+// built, as though EnableHealthCheck were set in the service config.
+func WithHealthCheck() BuilderOption {
+	return func(b *builder) {
+		b.healthCheck = true
+	}
+}
+
+// WithDefaultSpread sets the spread used when a service config does not
+// provide one.
+//
+// Defaults to DefaultSpread.
+func WithDefaultSpread(spread uint8) BuilderOption {
+	return func(b *builder) {
+		if spread > 0 {
+			b.defaultSpread = spread
+		}
+	}
+}
+
+// Logger is the subset of grpclog.LoggerV2 used to log the activity of a
+// balancer, which allows logs to be routed to any logger. Any
+// grpclog.LoggerV2, such as one returned by grpclog.Component, satisfies it.
+type Logger interface {
+	Infof(format string, args ...any)
+	Warningf(format string, args ...any)
+	V(l int) bool
+}
+
+// WithLogger sets the logger used by the builder and the balancers it builds,
+// such as to attribute log lines to a specific channel.
+//
+// Defaults to the grpclog component "consistenthashring".
+func WithLogger(logger Logger) BuilderOption {
+	return func(b *builder) {
+		b.logger = logger
+	}
+}
+
+// WithReplicationFactorWarningThreshold sets the replication factor above
+// which parsing a service config logs a warning.
+//
+// Defaults to DefaultReplicationFactorWarningThreshold. To reject replication
+// factors outright, use WithMaxReplicationFactor instead.
+func WithReplicationFactorWarningThreshold(threshold uint16) BuilderOption {
+	return func(b *builder) {
+		b.rfWarning = threshold
+	}
+}
+
+// WithMaxReplicationFactor sets the largest replication factor a service
+// config can set, such as to guard against one that would exhaust memory.
+// Parsing a config with a larger one fails with an error wrapping
+// hashring.ErrReplicationFactorTooLarge.
+//
+// Defaults to 0, which means there's no limit.
+func WithMaxReplicationFactor(maxReplicationFactor uint16) BuilderOption {
+	return func(b *builder) {
+		b.maxRF = maxReplicationFactor
+	}
+}
+
+// WithRand sets the random number generator used to select among the
+// candidates when spread is greater than 1. It must return a number in the
+// half-open interval [0,n) and be safe for concurrent use.
+//
+// Defaults to a fast generator backed by the runtime.
+func WithRand(rand func(n uint8) int) BuilderOption {
+	return func(b *builder) {
+		b.rand = rand
+	}
+}
+
+// WithPickTracer sets a PickTracer that is notified of the backend chosen for
+// each request.
+func WithPickTracer(tracer PickTracer) BuilderOption {
+	return func(b *builder) {
+		b.tracer = tracer
+	}
+}
+
+// WithRejectEmptyKeys makes pickers fail requests whose key is empty with
+// ErrEmptyKey, rather than sending them all to whichever backend owns the hash
+// of the empty key. This surfaces requests that forgot to set a key.
+func WithRejectEmptyKeys() BuilderOption {
+	return func(b *builder) {
+		b.rejectEmpty = true
+	}
+}
+
+// WithOnRingEmpty sets a function that is called whenever the hashring of a
+// balancer becomes empty or stops being empty, such as to fail a readiness
+// check while there are no backends to send requests to. It's called with
+// true when the last member is removed and with false when the first member
+// is added, including the first time the resolver returns any.
+//
+// fn is called on a goroutine of its own rather than by the balancer as it
+// processes resolver updates, so a slow fn doesn't hold them up, and it may
+// be called shortly after the transition. Calls for a balancer are never
+// concurrent and arrive in the order the transitions happened.
+func WithOnRingEmpty(fn func(empty bool)) BuilderOption {
+	return func(b *builder) {
+		b.onRingEmpty = fn
+	}
+}
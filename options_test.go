@@ -0,0 +1,559 @@
+package consistent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/authzed/consistent/hashring"
+)
+
+func TestNewBuilderOptions(t *testing.T) {
+	var logs bytes.Buffer
+	b := NewBuilder(
+		xxhash.Sum64,
+		WithKeyFunc(MetadataKeyFunc("x-shard-key")),
+		WithHealthCheck(),
+		WithDefaultSpread(2),
+		WithLogger(grpclog.NewLoggerV2(&logs, io.Discard, io.Discard)),
+		WithRand(func(n uint8) int { return int(n) - 1 }),
+	)
+
+	cfg, err := b.ParseConfig([]byte(`{"replicationFactor": 100}`))
+	require.NoError(t, err)
+	require.Equal(t, &BalancerConfig{
+		ReplicationFactor: 100,
+		Spread:            2,
+		EnableHealthCheck: true,
+	}, cfg)
+	require.Contains(t, logs.String(), "parsed balancer config")
+
+	// A spread from the service config takes precedence over the default.
+	cfg, err = b.ParseConfig([]byte(`{"replicationFactor": 100, "spread": 3}`))
+	require.NoError(t, err)
+	require.Equal(t, uint8(3), cfg.(*BalancerConfig).Spread)
+
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+				{ServerName: "t", Addr: "3"},
+			},
+		},
+		BalancerConfig: cfg,
+	}))
+	p := (<-states).Picker.(*picker)
+
+	require.Equal(t, uint8(3), p.spread)
+	require.Equal(t, 2, p.rand(3))
+	require.True(t, p.preferReady)
+	require.True(t, cc.subConnOpt[cc.subConn("t/1")].HealthCheckEnabled)
+
+	// The key is read from metadata.
+	_, err = p.Pick(balancer.PickInfo{
+		Ctx: metadata.AppendToOutgoingContext(context.Background(), "x-shard-key", "test"),
+	})
+	require.NoError(t, err)
+}
+
+func TestWithMetadataKeys(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64, WithMetadataKeys("|", "x-tenant", "x-type", "x-id"))
+	p := &picker{
+		hashring: hashring.MustNew(xxhash.Sum64, 100),
+		spread:   1,
+		keyFn:    b.(*builder).keyFn,
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, p.hashring.Add(subConnMember{key: id, SubConn: &fakeSubConn{id: id}}))
+	}
+
+	// Requests are routed by the joined header values, as though they had
+	// been given that key.
+	for i := 0; i < 100; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		fromHeaders, err := p.Pick(balancer.PickInfo{
+			Ctx: metadata.AppendToOutgoingContext(context.Background(), "x-tenant", tenant, "x-id", "obj"),
+		})
+		require.NoError(t, err)
+
+		fromContext, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), tenant+"||obj")})
+		require.NoError(t, err)
+		require.Same(t, fromContext.SubConn, fromHeaders.SubConn)
+	}
+}
+
+func TestNewBuilderDefaults(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+
+	cfg, err := b.ParseConfig([]byte(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, &BalancerConfig{
+		ReplicationFactor: DefaultReplicationFactor,
+		Spread:            DefaultSpread,
+	}, cfg)
+
+	// A zero default spread is ignored.
+	b = NewBuilder(xxhash.Sum64, WithDefaultSpread(0))
+	cfg, err = b.ParseConfig([]byte(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, uint8(DefaultSpread), cfg.(*BalancerConfig).Spread)
+}
+
+type pickRecord struct {
+	ctx     context.Context
+	key     string
+	backend string
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	picks []pickRecord
+}
+
+func (t *recordingTracer) TracePick(ctx context.Context, key []byte, backend string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.picks = append(t.picks, pickRecord{ctx: ctx, key: string(key), backend: backend})
+}
+
+func TestWithPickTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	b := NewBuilder(xxhash.Sum64, WithPickTracer(tracer))
+
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+				{ServerName: "t", Addr: "3"},
+			},
+		},
+		BalancerConfig: &BalancerConfig{ReplicationFactor: 100, Spread: 1},
+	}))
+	p := (<-states).Picker.(*picker)
+
+	var expected []pickRecord
+	for _, spread := range []uint8{1, 2} {
+		for _, key := range []string{"a", "b", "c"} {
+			ctx := ContextWithKey(ContextWithSpread(context.Background(), spread), key)
+			result, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+			require.NoError(t, err)
+
+			expected = append(expected, pickRecord{ctx: ctx, key: key, backend: result.SubConn.(*fakeSubConn).id})
+		}
+	}
+	require.Equal(t, expected, tracer.picks)
+
+	// Failed picks aren't traced.
+	_, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+	require.Error(t, err)
+	require.Len(t, tracer.picks, len(expected))
+}
+
+func TestReplicationFactorLimits(t *testing.T) {
+	var logs bytes.Buffer
+	logger := grpclog.NewLoggerV2(io.Discard, &logs, io.Discard)
+
+	b := NewBuilder(xxhash.Sum64, WithLogger(logger))
+	_, err := b.ParseConfig([]byte(`{"replicationFactor": 5000}`))
+	require.NoError(t, err)
+	require.Empty(t, logs.String())
+
+	_, err = b.ParseConfig([]byte(`{"replicationFactor": 5001}`))
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), "replication factor 5001")
+
+	// The threshold can be raised.
+	logs.Reset()
+	b = NewBuilder(xxhash.Sum64, WithLogger(logger), WithReplicationFactorWarningThreshold(10000))
+	_, err = b.ParseConfig([]byte(`{"replicationFactor": 5001}`))
+	require.NoError(t, err)
+	require.Empty(t, logs.String())
+
+	// Configs exceeding the hard limit are rejected.
+	b = NewBuilder(xxhash.Sum64, WithLogger(logger), WithMaxReplicationFactor(1000))
+	_, err = b.ParseConfig([]byte(`{"replicationFactor": 1001}`))
+	require.ErrorIs(t, err, hashring.ErrReplicationFactorTooLarge)
+	_, err = b.ParseConfig([]byte(`{"replicationFactor": 1000}`))
+	require.NoError(t, err)
+}
+
+func TestParseConfigSpreadStrategy(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+
+	cfg, err := b.ParseConfig([]byte(`{}`))
+	require.NoError(t, err)
+	require.Empty(t, cfg.(*BalancerConfig).SpreadStrategy)
+
+	for _, strategy := range []SpreadStrategy{SpreadRandom, SpreadLeastLoaded, SpreadPowerOfTwo} {
+		cfg, err := b.ParseConfig([]byte(fmt.Sprintf(`{"spreadStrategy": %q}`, strategy)))
+		require.NoError(t, err)
+		require.Equal(t, strategy, cfg.(*BalancerConfig).SpreadStrategy)
+	}
+
+	_, err = b.ParseConfig([]byte(`{"spreadStrategy": "roundRobin"}`))
+	require.ErrorContains(t, err, `unknown spread strategy "roundRobin"`)
+}
+
+func TestParseConfigSpreadWeights(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+
+	cfg, err := b.ParseConfig([]byte(`{"spread": 3, "spreadWeights": [0.7, 0.2, 0.1]}`))
+	require.NoError(t, err)
+	require.Equal(t, []float64{0.7, 0.2, 0.1}, cfg.(*BalancerConfig).SpreadWeights)
+
+	for config, message := range map[string]string{
+		`{"spreadWeights": [0.5, 0.5]}`:                                              "got 2 weights for a spread of 1",
+		`{"spread": 2, "spreadWeights": [1]}`:                                        "got 1 weights for a spread of 2",
+		`{"spread": 2, "spreadWeights": [0.5, 0.6]}`:                                 "weights sum to 1.1 rather than 1",
+		`{"spread": 2, "spreadWeights": [1.5, -0.5]}`:                                "weight -0.5 is not a finite, non-negative number",
+		`{"spread": 2, "spreadWeights": [0.5, 0.5], "spreadStrategy": "powerOfTwo"}`: `weights can't be used with spread strategy "powerOfTwo"`,
+	} {
+		_, err := b.ParseConfig([]byte(config))
+		require.ErrorContains(t, err, "invalid spread weights", config)
+		require.ErrorContains(t, err, message, config)
+	}
+}
+
+func TestParseConfigEmptyUpdateGrace(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+
+	cfg, err := b.ParseConfig([]byte(`{}`))
+	require.NoError(t, err)
+	require.Zero(t, cfg.(*BalancerConfig).EmptyUpdateGrace)
+
+	cfg, err = b.ParseConfig([]byte(`{"emptyUpdateGrace": "2.5s"}`))
+	require.NoError(t, err)
+	require.Equal(t, 2500*time.Millisecond, cfg.(*BalancerConfig).EmptyUpdateGrace)
+
+	_, err = b.ParseConfig([]byte(`{"emptyUpdateGrace": "soon"}`))
+	require.ErrorContains(t, err, "invalid emptyUpdateGrace")
+
+	_, err = b.ParseConfig([]byte(`{"emptyUpdateGrace": "-1s"}`))
+	require.ErrorContains(t, err, "invalid empty update grace -1s")
+}
+
+func TestParseConfigPickCacheSize(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64)
+
+	cfg, err := b.ParseConfig([]byte(`{}`))
+	require.NoError(t, err)
+	require.Zero(t, cfg.(*BalancerConfig).PickCacheSize)
+
+	cfg, err = b.ParseConfig([]byte(`{"pickCacheSize": 1024}`))
+	require.NoError(t, err)
+	require.Equal(t, 1024, cfg.(*BalancerConfig).PickCacheSize)
+
+	_, err = b.ParseConfig([]byte(`{"pickCacheSize": -1}`))
+	require.ErrorContains(t, err, "invalid pick cache size -1")
+}
+
+type recordingLogger struct {
+	mu       sync.Mutex
+	verbose  bool
+	infos    []string
+	warnings []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warningf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) V(int) bool { return l.verbose }
+
+func TestWithLoggerCustom(t *testing.T) {
+	logger := &recordingLogger{verbose: true}
+	b := NewBuilder(xxhash.Sum64, WithLogger(logger))
+
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 10, Spread: 1}
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "1"},
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.Contains(t, logger.infos, "2 hashring members found")
+	require.Contains(t, logger.infos, "hashring member t/1")
+	require.Contains(t, logger.infos, "hashring member t/2")
+
+	logger.infos = nil
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{ServerName: "t", Addr: "2"},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.Contains(t, logger.infos, "1 hashring members found")
+	require.NotContains(t, logger.infos, "hashring member t/1")
+
+	// Verbose messages are only logged when enabled.
+	logger.verbose = false
+	logger.infos = nil
+	bb.UpdateSubConnState(cc.subConn("t/2"), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	require.Empty(t, logger.infos)
+}
+
+func TestWithRejectEmptyKeys(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		reject := reject
+		t.Run(fmt.Sprintf("reject=%t", reject), func(t *testing.T) {
+			var opts []BuilderOption
+			if reject {
+				opts = append(opts, WithRejectEmptyKeys())
+			}
+			b := NewBuilder(xxhash.Sum64, opts...)
+
+			cc := newFakeClientConn()
+			states := make(chan balancer.State, 1)
+			go func() {
+				for s := range cc.stateCh {
+					states <- s
+				}
+			}()
+
+			bb := b.Build(cc, balancer.BuildOptions{})
+			require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+				ResolverState: resolver.State{
+					Addresses: []resolver.Address{
+						{ServerName: "t", Addr: "1"},
+						{ServerName: "t", Addr: "2"},
+						{ServerName: "t", Addr: "3"},
+					},
+				},
+				BalancerConfig: &BalancerConfig{ReplicationFactor: 100, Spread: 1},
+			}))
+			p := (<-states).Picker.(*picker)
+
+			// A non-empty key is always picked.
+			_, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key")})
+			require.NoError(t, err)
+
+			var backends []balancer.SubConn
+			for _, key := range [][]byte{nil, {}} {
+				result, err := p.Pick(balancer.PickInfo{Ctx: context.WithValue(context.Background(), CtxKey, key)})
+				if reject {
+					require.ErrorIs(t, err, ErrEmptyKey)
+					continue
+				}
+
+				require.NoError(t, err)
+				backends = append(backends, result.SubConn)
+			}
+
+			// Otherwise, nil and empty keys deterministically share a backend.
+			if !reject {
+				require.Len(t, backends, 2)
+				require.Equal(t, backends[0], backends[1])
+			}
+		})
+	}
+}
+
+func TestWithOnRingEmpty(t *testing.T) {
+	var mu sync.Mutex
+	var calls []bool
+	b := NewBuilder(xxhash.Sum64, WithOnRingEmpty(func(empty bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, empty)
+	}))
+	// Transitions are delivered asynchronously.
+	requireCalls := func(want ...bool) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Equal(want, calls)
+		}, time.Second, time.Millisecond)
+	}
+
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 100, Spread: 1}
+	update := func(addrs ...string) error {
+		state := resolver.State{}
+		for _, addr := range addrs {
+			state.Addresses = append(state.Addresses, resolver.Address{ServerName: "t", Addr: addr})
+		}
+		return bb.UpdateClientConnState(balancer.ClientConnState{ResolverState: state, BalancerConfig: config})
+	}
+
+	// The hashring starts out empty.
+	require.ErrorIs(t, update(), balancer.ErrBadResolverState)
+	requireCalls()
+
+	require.NoError(t, update("1", "2"))
+	requireCalls(false)
+	require.NoError(t, update("2"))
+	requireCalls(false)
+
+	require.ErrorIs(t, update(), balancer.ErrBadResolverState)
+	requireCalls(false, true)
+	require.ErrorIs(t, update(), balancer.ErrBadResolverState)
+	requireCalls(false, true)
+
+	require.NoError(t, update("3"))
+	requireCalls(false, true, false)
+
+	// The hashring only becomes empty once a grace period runs out.
+	config = &BalancerConfig{ReplicationFactor: 100, Spread: 1, EmptyUpdateGrace: 10 * time.Millisecond}
+	require.NoError(t, update("3"))
+	require.ErrorIs(t, update(), balancer.ErrBadResolverState)
+	requireCalls(false, true, false)
+	requireCalls(false, true, false, true)
+}
+
+func TestWithOnRingEmptyBlocked(t *testing.T) {
+	unblock := make(chan struct{})
+	calls := make(chan bool, 3)
+	b := NewBuilder(xxhash.Sum64, WithOnRingEmpty(func(empty bool) {
+		<-unblock
+		calls <- empty
+	}))
+
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	// The balancer isn't held up by a callback that hasn't returned, and the
+	// transitions are still delivered in order once it does.
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 100, Spread: 1}
+	for _, addrs := range [][]resolver.Address{{{ServerName: "t", Addr: "1"}}, nil, {{ServerName: "t", Addr: "2"}}} {
+		_ = bb.UpdateClientConnState(balancer.ClientConnState{ResolverState: resolver.State{Addresses: addrs}, BalancerConfig: config})
+	}
+
+	close(unblock)
+	require.False(t, <-calls)
+	require.True(t, <-calls)
+	require.False(t, <-calls)
+}
+
+type nodeIDKey struct{}
+
+func TestWithMemberKeyFunc(t *testing.T) {
+	b := NewBuilder(xxhash.Sum64, WithMemberKeyFunc(func(addr resolver.Address) string {
+		return addr.Attributes.Value(nodeIDKey{}).(string)
+	}))
+
+	cc := newFakeClientConn()
+	go func() {
+		for range cc.stateCh {
+		}
+	}()
+
+	bb := b.Build(cc, balancer.BuildOptions{})
+	config := &BalancerConfig{ReplicationFactor: 10, Spread: 1}
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{Addr: "10.0.0.1:50051", Attributes: attributes.New(nodeIDKey{}, "node-a")},
+				{Addr: "10.0.0.2:50051", Attributes: attributes.New(nodeIDKey{}, "node-b")},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.ElementsMatch(t, []RingMember{
+		{Key: "node-a", VirtualNodes: 10},
+		{Key: "node-b", VirtualNodes: 10},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+
+	// A backend that moves to a new address keeps its key, and its subconn is
+	// replaced by one for the new address.
+	require.NotNil(t, cc.subConn("10.0.0.2:50051"))
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState: resolver.State{
+			Addresses: []resolver.Address{
+				{Addr: "10.0.0.1:50051", Attributes: attributes.New(nodeIDKey{}, "node-a")},
+				{Addr: "10.0.0.3:50051", Attributes: attributes.New(nodeIDKey{}, "node-b")},
+			},
+		},
+		BalancerConfig: config,
+	}))
+	require.ElementsMatch(t, []RingMember{
+		{Key: "node-a", VirtualNodes: 10},
+		{Key: "node-b", VirtualNodes: 10},
+	}, b.(BalancerTracker).LastBalancer().RingSnapshot())
+	require.Nil(t, cc.subConn("10.0.0.2:50051"))
+
+	sc := cc.subConn("10.0.0.3:50051")
+	require.NotNil(t, sc)
+	require.Same(t, sc, bb.(*ringBalancer).subConns["node-b"].SubConn)
+
+	members, err := bb.(*ringBalancer).hashring.FindN([]byte("key"), 2)
+	require.NoError(t, err)
+	require.Contains(t, []balancer.SubConn{members[0].(subConnMember).SubConn, members[1].(subConnMember).SubConn}, sc)
+}
+
+func TestDefaultMemberKey(t *testing.T) {
+	require.Equal(t, "t/1", DefaultMemberKey(resolver.Address{ServerName: "t", Addr: "1"}))
+	require.Equal(t, "10.0.0.1:50051", DefaultMemberKey(resolver.Address{Addr: "10.0.0.1:50051"}), "keys of addresses without a ServerName are unchanged")
+	require.Empty(t, DefaultMemberKey(resolver.Address{}))
+
+	// Addresses that only concatenate to the same string have different keys.
+	require.NotEqual(t,
+		DefaultMemberKey(resolver.Address{ServerName: "t", Addr: "1"}),
+		DefaultMemberKey(resolver.Address{ServerName: "t1", Addr: ""}),
+	)
+}
@@ -0,0 +1,40 @@
+package consistent
+
+import "github.com/authzed/consistent/hashring"
+
+// MemberKey is a hashring member identified only by its key, such as the key
+// DefaultMemberKey derives for a backend's address. It lets code outside of a
+// gRPC ClientConn build a hashring with the same members as a balancer's.
+type MemberKey string
+
+// Key returns the member's key.
+func (k MemberKey) Key() string { return string(k) }
+
+// NewOwnerRing builds a standalone hashring that places keys exactly as a
+// balancer does with the same hash function, replication factor, and member
+// keys, so that a client can compute which backend owns a request key without
+// making an RPC, such as to keep a local cache per backend. The members of the
+// returned hashring are MemberKeys.
+//
+// The member keys must be the ones the balancer's MemberKeyFunc derives for
+// the backends' addresses, "server-name/host:port" by default, and a
+// replication factor of 0 uses DefaultReplicationFactor, as in a service
+// config. Backends with a weight must be added with AddWeighted instead.
+// With a Spread greater than 1, the balancer chooses among the members
+// returned by FindN rather than always using the owner returned by Find.
+//
+// If any member keys are duplicated or empty, an error joining
+// hashring.ErrMemberAlreadyExists or hashring.ErrEmptyMemberKey for each is
+// returned.
+func NewOwnerRing(hashfn hashring.HashFunc, replicationFactor uint16, memberKeys ...string) (*hashring.Ring, error) {
+	if replicationFactor == 0 {
+		replicationFactor = DefaultReplicationFactor
+	}
+
+	members := make([]hashring.Member, 0, len(memberKeys))
+	for _, key := range memberKeys {
+		members = append(members, MemberKey(key))
+	}
+
+	return hashring.NewWithMembers(hashfn, replicationFactor, members)
+}
@@ -0,0 +1,70 @@
+package consistent
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/authzed/consistent/hashring"
+)
+
+func TestNewOwnerRing(t *testing.T) {
+	cc := newFakeClientConn()
+	states := make(chan balancer.State, 1)
+	go func() {
+		for s := range cc.stateCh {
+			states <- s
+		}
+	}()
+
+	addrs := []resolver.Address{
+		{ServerName: "cache", Addr: "10.0.0.1:6379"},
+		{ServerName: "cache", Addr: "10.0.0.2:6379"},
+		{ServerName: "cache", Addr: "10.0.0.3:6379"},
+	}
+	b := NewBuilder(xxhash.Sum64)
+	cfg, err := b.ParseConfig([]byte(`{}`))
+	require.NoError(t, err)
+	bb := b.Build(cc, balancer.BuildOptions{})
+	require.NoError(t, bb.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState:  resolver.State{Addresses: addrs},
+		BalancerConfig: cfg,
+	}))
+	<-states
+	var p balancer.Picker
+	for _, addr := range addrs {
+		bb.UpdateSubConnState(cc.subConn(DefaultMemberKey(addr)), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+		p = (<-states).Picker
+	}
+
+	// The client knows the backends' addresses and the replication factor,
+	// which was left at the default.
+	keys := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		keys = append(keys, DefaultMemberKey(addr))
+	}
+	ring, err := NewOwnerRing(xxhash.Sum64, 0, keys...)
+	require.NoError(t, err)
+	require.Equal(t, uint16(DefaultReplicationFactor), ring.ReplicationFactor())
+
+	for i := 0; i < 1000; i++ {
+		key := "user:" + strconv.Itoa(i)
+		result, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), key)})
+		require.NoError(t, err)
+
+		owner, err := ring.Find([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, result.SubConn.(*fakeSubConn).id, owner.Key(), key)
+		require.IsType(t, MemberKey(""), owner)
+	}
+
+	_, err = NewOwnerRing(xxhash.Sum64, 100, "a", "a", "")
+	require.ErrorIs(t, err, hashring.ErrMemberAlreadyExists)
+	require.ErrorIs(t, err, hashring.ErrEmptyMemberKey)
+}
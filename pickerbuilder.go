@@ -0,0 +1,92 @@
+package consistent
+
+import (
+	"math"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+
+	"github.com/authzed/consistent/hashring"
+)
+
+// NewPickerBuilder allocates a base.PickerBuilder that builds consistent
+// hashring pickers over the Ready subconnections provided by gRPC's base
+// balancer, which then manages the subconnections, health checking, and
+// connectivity state instead of this package's balancer.
+//
+// Only the ReplicationFactor and Spread of config are used, with the same
+// defaults as a service config. The hashring uses hashfn and is rebuilt every
+// time the set of Ready subconnections changes, so keys only ever map to Ready
+// backends.
+//
+// The following is an example usage:
+// ```go
+// balancer.Register(base.NewBalancerBuilder(
+// "consistent-hashring-base",
+// consistent.NewPickerBuilder(xxhash.Sum64, consistent.BalancerConfig{ReplicationFactor: 100}),
+// base.Config{HealthCheck: true},
+// ))
+// ```
+func NewPickerBuilder(hashfn hashring.HashFunc, config BalancerConfig, opts ...BuilderOption) base.PickerBuilder {
+	b := NewBuilder(hashfn, opts...).(*builder)
+
+	if config.ReplicationFactor == 0 {
+		config.ReplicationFactor = DefaultReplicationFactor
+	}
+
+	if config.Spread == 0 {
+		config.Spread = b.defaultSpread
+	}
+
+	return &pickerBuilder{builder: b, config: config}
+}
+
+type pickerBuilder struct {
+	*builder
+	config BalancerConfig
+}
+
+var _ base.PickerBuilder = (*pickerBuilder)(nil)
+
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	ring := hashring.MustNew(pb.hashfn, pb.config.ReplicationFactor)
+	for sc, scInfo := range info.ReadySCs {
+		addr := scInfo.Address
+		key := pb.memberKeyFn(addr)
+		weight := addressWeight(addr)
+		if err := ring.AddWeighted(subConnMember{SubConn: sc, key: key, weight: weight}, weight); err != nil {
+			pb.logger.Warningf("couldn't add %q to hashring: %v", key, err)
+		}
+	}
+
+	// Every Ready subconnection may have been rejected, such as for having an
+	// invalid weight, which leaves nothing to pick from until they change.
+	if ring.Size() == 0 {
+		return base.NewErrPicker(hashring.ErrNotEnoughMembers)
+	}
+
+	members := ring.Size()
+	if members > math.MaxUint8 {
+		members = math.MaxUint8
+	}
+
+	// Fewer subconnections may be Ready than the spread calls for.
+	spread := pb.config.Spread
+	if int(spread) > members {
+		spread = uint8(members)
+	}
+
+	return &picker{
+		hashring:    ring,
+		numMembers:  uint8(members),
+		spread:      spread,
+		keyFn:       pb.keyFn,
+		rand:        pb.rand,
+		tracer:      pb.tracer,
+		rejectEmpty: pb.rejectEmpty,
+	}
+}
@@ -0,0 +1,69 @@
+package consistent
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/authzed/consistent/hashring"
+)
+
+func TestPickerBuilderAllRejected(t *testing.T) {
+	pb := NewPickerBuilder(xxhash.Sum64, BalancerConfig{ReplicationFactor: 1000, Spread: 2})
+
+	// A weight of 66 gives more virtual nodes than a member can have at a
+	// replication factor of 1000, so every Ready subconnection is rejected.
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+	for _, addr := range []string{"1", "2"} {
+		sc := &fakeSubConn{id: "t/" + addr}
+		info.ReadySCs[sc] = base.SubConnInfo{Address: AddressWithWeight(resolver.Address{ServerName: "t", Addr: addr}, 66)}
+	}
+
+	p := pb.Build(info)
+	for _, ctx := range []context.Context{
+		ContextWithKey(context.Background(), "key"),
+		ContextWithReplica(ContextWithKey(context.Background(), "key"), 1),
+	} {
+		_, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		require.ErrorIs(t, err, hashring.ErrNotEnoughMembers)
+	}
+}
+
+func TestPickerBuilder(t *testing.T) {
+	pb := NewPickerBuilder(xxhash.Sum64, BalancerConfig{Spread: 3})
+
+	_, err := pb.Build(base.PickerBuildInfo{}).Pick(balancer.PickInfo{Ctx: ContextWithKey(context.Background(), "key")})
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+
+	subConns := map[string]*fakeSubConn{}
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+	for _, addr := range []string{"1", "2"} {
+		sc := &fakeSubConn{id: "t/" + addr}
+		subConns[sc.id] = sc
+		info.ReadySCs[sc] = base.SubConnInfo{Address: resolver.Address{ServerName: "t", Addr: addr}}
+	}
+
+	p := pb.Build(info)
+	require.IsType(t, &picker{}, p)
+
+	ring := p.(*picker).hashring
+	require.ElementsMatch(t, []string{"t/1", "t/2"}, keys(ring.Members()))
+	require.Equal(t, uint8(2), p.(*picker).spread, "spread is capped by the Ready subconns")
+
+	// Picks follow the hashring.
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		got, err := p.Pick(balancer.PickInfo{Ctx: ContextWithKey(ContextWithSpread(context.Background(), 1), key)})
+		require.NoError(t, err)
+
+		owner, err := ring.Find([]byte(key))
+		require.NoError(t, err)
+		require.Same(t, subConns[owner.Key()], got.SubConn)
+	}
+}